@@ -39,7 +39,7 @@ const Playlist = {
         </div>
         <div id="songs">
             <hr>
-            <song @playSong="playSong" v-for="song in $store.state.currentPlaylist.tracks" :song="song" :key="song.videoId"></song>
+            <song @playSong="playSong" @enqueue="enqueue" v-for="song in $store.state.currentPlaylist.tracks" :song="song" :key="song.videoId"></song>
         </div>
 </div>`,
 
@@ -54,6 +54,10 @@ const Playlist = {
             this.$store.dispatch("playSong", {player: this.$route.params.player, playlist: this.$store.state.currentPlaylist, song: event})
         },
 
+        enqueue(event) {
+            this.$store.dispatch("enqueue", {player: this.$route.params.player, song: event.song, next: event.next})
+        },
+
         shuffle() {
             // JS doesn't have a random element function?
             // are you kidding me?
@@ -64,10 +68,87 @@ const Playlist = {
     }
 }
 
+const Queue = {
+    template: `<div id="queue" class="routerView">
+        <p style="font-weight: bold">
+            {{ playerState.total }} songs
+            <span v-if="playerState.total > playerState.queue.length" class="noHover">({{ playerState.queue.length }} loaded)</span>
+        </p>
+        <p class="button" style="margin: 20px 0;" @click="$store.dispatch('clearQueue', $route.params.player)">
+            <span class="material-icons" style="margin-right: 5px;">clear_all</span>
+            Clear
+        </p>
+        <div id="songs">
+            <hr>
+            <div v-for="(song, index) in playerState.queue" :key="index + song.videoId">
+                <div class="song" :style="{fontWeight: index == playerState.index ? 'bold' : 'normal'}">
+                    <img class="thumbnail" :src="thumbnail(song)">
+                    <div class="title"><span class="noHover">{{ song.title }}</span></div>
+                    <div class="artist"><span>{{ song.artists[0].name }}</span></div>
+                    <div class="album">
+                        <span class="material-icons" @click="move(index, index-1, song)">arrow_upward</span>
+                        <span class="material-icons" @click="move(index, index+1, song)">arrow_downward</span>
+                        <span class="material-icons" @click="remove(index, song)">delete</span>
+                    </div>
+                    <div class="duration"><span class="noHover">{{ song.duration }}</span></div>
+                </div>
+                <hr>
+            </div>
+        </div>
+</div>`,
+
+    methods: {
+        move(from, to, song) {
+            if (to < 0 || to >= this.playerState.queue.length) {
+                return
+            }
+
+            this.$store.dispatch("moveInQueue", {player: this.$route.params.player, from: from, to: to, videoId: song.videoId})
+        },
+
+        remove(index, song) {
+            this.$store.dispatch("removeFromQueue", {player: this.$route.params.player, index: index, videoId: song.videoId})
+        }
+    },
+
+    computed: {
+        playerState() {
+            s = this.$store.getters.playerState(this.$route.params.player)
+            return s == undefined ? {queue: [], index: 0, total: 0} : s
+        }
+    }
+}
+
+const History = {
+    template: `<div id="history" class="routerView">
+        <p style="font-weight: bold">Recently played</p>
+        <div id="songs">
+            <hr>
+            <div v-for="entry in $store.state.history" :key="entry.start + entry.song.videoId">
+                <div class="song">
+                    <img class="thumbnail" :src="thumbnail(entry.song)">
+                    <div class="title"><span class="noHover">{{ entry.song.title }}</span></div>
+                    <div class="artist"><span>{{ entry.song.artists.length > 0 ? entry.song.artists[0].name : "" }}</span></div>
+                    <div class="album"><span class="noHover">{{ new Date(entry.start).toLocaleString() }}</span></div>
+                    <div class="duration"><span class="noHover">{{ entry.endReason }}</span></div>
+                </div>
+                <hr>
+            </div>
+        </div>
+</div>`,
+
+    mounted() {
+        this.$store.commit("history", [])
+        this.$store.dispatch("getHistory", this.$route.params.player)
+    }
+}
+
 const routes = [
     { path: "/", component: Home },
     { path: "/player/:player/", component: PlayerHome },
-    { path: "/player/:player/playlist/:id", component: Playlist }
+    { path: "/player/:player/playlist/:id", component: Playlist },
+    { path: "/player/:player/queue", component: Queue },
+    { path: "/player/:player/history", component: History }
 ]
 
 const router = VueRouter.createRouter({
@@ -78,6 +159,11 @@ const router = VueRouter.createRouter({
 const app = Vue.createApp({})
 
 app.config.devtools = true
+
+// Songs from local catalogs may not have any thumbnails
+app.config.globalProperties.thumbnail = (song) => {
+    return song.thumbnails && song.thumbnails.length > 0 ? song.thumbnails[0].url : ""
+}
 app.use(router)
 app.use(store)
 
@@ -94,19 +180,23 @@ app.component("playlist-cover", {
     template: `<div class="playlistCover" @click="this.$router.push('/player/'+this.$route.params.player+'/playlist/'+playlist.id)">
     <img :src="playlist.thumbnail">
     <span class="playlistTitle">{{ playlist.title }}</span>
-    <span class="playlistCount">{{ playlist.count }} songs</span>
+    <span class="playlistCount">{{ playlist.trackCount }} songs</span>
 </div>`
 })
 
 app.component("song", {
     props: ["song"],
-    emits: ["playSong"],
+    emits: ["playSong", "enqueue"],
     template: `<div class="song">
-    <img class="thumbnail" @click="$emit('playSong', song)" :src="song.thumbnails[0].url">
+    <img class="thumbnail" @click="$emit('playSong', song)" :src="thumbnail(song)">
     <div class="title"><span @click="$emit('playSong', song)">{{ song.title }}</span></div>
     <div class="artist"><span>{{ song.artists[0].name }}</span></div>
     <div class="album"><span>{{ song.album != null ? song.album.name : "" }}</span></div>
-    <div class="duration"><span class="noHover">{{ song.duration }}</span></div>
+    <div class="duration">
+        <span class="material-icons" title="Play next" @click="$emit('enqueue', {song: song, next: true})">queue_play_next</span>
+        <span class="material-icons" title="Add to queue" @click="$emit('enqueue', {song: song, next: false})">playlist_add</span>
+        <span class="noHover">{{ song.duration }}</span>
+    </div>
 </div>
 <hr>`
 })
@@ -116,6 +206,9 @@ app.component("player-controls", {
 <div id="playerControls" v-if="Object.keys(playerState.song).length > 0 || playerState.loading">
 
     <div id="playerControlButtons">
+        <span class="material-icons md-48" :style="{opacity: playerState.shuffle ? 1 : 0.4}" @click="$store.dispatch('toggleShuffle', $route.params.player)">
+            shuffle
+        </span>
         <span class="material-icons md-48" @click="$store.dispatch('previousSong', $route.params.player)">
             skip_previous
         </span>
@@ -128,6 +221,36 @@ app.component("player-controls", {
         <span class="material-icons md-48" @click="$store.dispatch('nextSong', $route.params.player)">
             skip_next
         </span>
+        <span class="noHover" v-if="playerState.party && playerState.party.enabled">
+            {{ playerState.party.votes }}/{{ playerState.party.needed }}
+        </span>
+        <span class="material-icons md-48" :style="{opacity: playerState.repeat != 'off' ? 1 : 0.4}" @click="$store.dispatch('cycleRepeat', $route.params.player)">
+            {{ playerState.repeat == 'one' ? 'repeat_one' : 'repeat' }}
+        </span>
+        <span class="material-icons md-48" title="Autoplay" :style="{opacity: playerState.autoplay ? 1 : 0.4}" @click="$store.dispatch('toggleAutoplay', $route.params.player)">
+            all_inclusive
+        </span>
+        <span class="material-icons md-48" :title="partyTitle" :style="{opacity: playerState.party && playerState.party.enabled ? 1 : 0.4}" @click="toggleParty">
+            celebration
+        </span>
+        <span class="material-icons md-48" :style="{opacity: playerState.showLyrics ? 1 : 0.4}" @click="$store.dispatch('toggleLyrics', $route.params.player)">
+            lyrics
+        </span>
+        <span class="material-icons md-48" title="Edit display text" :style="{opacity: editingTemplate ? 1 : 0.4}" @click="editTemplate">
+            edit_note
+        </span>
+        <span class="material-icons md-48" title="Progress on display" :style="{opacity: playerState.progress ? 1 : 0.4}" @click="$store.dispatch('toggleProgress', $route.params.player)">
+            timelapse
+        </span>
+        <span class="material-icons md-48" title="Show the display" :style="{opacity: watchingDisplay ? 1 : 0.4}" @click="toggleDisplay">
+            monitor
+        </span>
+        <span class="material-icons md-48" @click="$router.push('/player/'+$route.params.player+'/queue')">
+            queue_music
+        </span>
+        <span class="material-icons md-48" @click="$router.push('/player/'+$route.params.player+'/history')">
+            history
+        </span>
     </div>
     
     <div id="currentSong"
@@ -137,21 +260,64 @@ app.component("player-controls", {
     </div>
 
     <div id="currentSong" v-else>
-        <img class="thumbnail" :src="playerState.song.thumbnails[0].url">
+        <img class="thumbnail" :src="thumbnail(playerState.song)">
         <div id="currentSongInfo">
             <span class="title">{{ playerState.song.title }}</span>
+            <p v-if="playerState.chapter >= 0 && playerState.song.chapters">
+                <span class="noHover">{{ playerState.song.chapters[playerState.chapter].title }}</span>
+            </p>
             <p>
                 <span class="artist">{{ playerState.song.artists[0].name }}</span>
                 <span class="noHover" v-if="playerState.song.album != null">  -  </span>
                 <span class="album">{{ playerState.song.album != null ? playerState.song.album.name : "" }}</span>
             </p>
+            <p v-if="playerState.showLyrics && playerState.lyric >= 0 && playerState.lyrics">
+                <span class="noHover">{{ playerState.lyrics[playerState.lyric].text }}</span>
+            </p>
         </div>
     </div>
+    <canvas id="displayPreview" ref="display" v-if="watchingDisplay"></canvas>
     <div id="playerVolume">
         <input type="range" min="0" max="100" step="5" :value="playerState.volume" @input="setVolume">
+        <select v-if="playerState.layouts && playerState.layouts.length > 1" :value="playerState.layout" @change="setLayout">
+            <option value="single">One line</option>
+            <option value="twoLine">Two lines</option>
+        </select>
+        <div id="templateEditor" v-if="editingTemplate">
+            <textarea rows="2" cols="60" v-model="template"></textarea>
+            <button @click="saveTemplate">Save</button>
+            <button @click="resetTemplate">Default</button>
+        </div>
+        <select v-if="otherPlayers.length > 0" @change="transfer">
+            <option value="">Transfer to...</option>
+            <option v-for="player in otherPlayers" :value="player.id" :key="player.id">{{ player.name }}</option>
+        </select>
     </div>
 </div>`,
 
+    data() {
+        return {
+            editingTemplate: false,
+            template: "",
+            watchingDisplay: null,
+        }
+    },
+
+    watch: {
+        frame() {
+            this.drawDisplay()
+        },
+
+        "$route.params.player"() {
+            this.stopWatchingDisplay()
+            this.$store.dispatch("attach", this.$route.params.player || "")
+        }
+    },
+
+    unmounted() {
+        this.stopWatchingDisplay()
+    },
+
     mounted() {
         // Connect to the websocket and load current states of players
         console.log("Connecting to websocket")
@@ -161,11 +327,19 @@ app.component("player-controls", {
         ws.onmessage = (event) => {
             e = JSON.parse(event.data)
             console.log(e)
-            this.$store.commit("playerState", e)
+            if (e.display) {
+                this.$store.commit("displayFrame", e.display)
+            } else if (e.partyToken) {
+                this.$store.dispatch("keepPartyToken", e.partyToken)
+            } else {
+                this.$store.commit("playerState", e)
+            }
         }
 
         ws.onopen = () => {
             console.log("Connected to websocket")
+            this.$store.dispatch("identify")
+            this.$store.dispatch("attach", this.$route.params.player || "")
         }
 
         ws.onerror = () => {
@@ -179,10 +353,110 @@ app.component("player-controls", {
                 player: this.$route.params.player,
                 volume: Number(event.target.value),
             })
+        },
+
+        editTemplate() {
+            this.editingTemplate = !this.editingTemplate
+            if (this.editingTemplate && this.playerState.templates) {
+                this.template = this.playerState.templates[this.playerState.layout]
+            }
+        },
+
+        saveTemplate() {
+            this.$store.dispatch("setTemplate", {player: this.$route.params.player, layout: this.playerState.layout, template: this.template})
+            this.editingTemplate = false
+        },
+
+        resetTemplate() {
+            this.$store.dispatch("setTemplate", {player: this.$route.params.player, layout: this.playerState.layout, template: ""})
+            this.editingTemplate = false
+        },
+
+        setLayout(event) {
+            this.$store.dispatch("setLayout", {player: this.$route.params.player, layout: event.target.value})
+        },
+
+        toggleDisplay() {
+            if (this.watchingDisplay) {
+                this.stopWatchingDisplay()
+                return
+            }
+
+            this.watchingDisplay = this.$route.params.player
+            this.$store.dispatch("watchDisplay", {player: this.watchingDisplay, on: true})
+            this.$nextTick(this.drawDisplay)
+        },
+
+        stopWatchingDisplay() {
+            if (!this.watchingDisplay) {
+                return
+            }
+
+            this.$store.dispatch("watchDisplay", {player: this.watchingDisplay, on: false})
+            this.watchingDisplay = null
+        },
+
+        drawDisplay() {
+            // Frames are packed a row at a time, with the leftmost pixel in the top bit
+            let canvas = this.$refs.display
+            let frame = this.frame
+            if (!canvas || !frame) {
+                return
+            }
+
+            let scale = 2
+            canvas.width = frame.width * scale
+            canvas.height = frame.height * scale
+
+            let ctx = canvas.getContext("2d")
+            ctx.fillStyle = "#101010"
+            ctx.fillRect(0, 0, canvas.width, canvas.height)
+            ctx.fillStyle = "#40e0ff"
+
+            let bytes = atob(frame.frame)
+            let rowBytes = Math.ceil(frame.width / 8)
+            for (let y = 0; y < frame.height; y++) {
+                for (let x = 0; x < frame.width; x++) {
+                    if (bytes.charCodeAt(y * rowBytes + (x >> 3)) & (0x80 >> (x & 7))) {
+                        ctx.fillRect(x * scale, y * scale, scale, scale)
+                    }
+                }
+            }
+        },
+
+        toggleParty() {
+            party = this.playerState.party
+            this.$store.dispatch("toggleParty", {player: this.$route.params.player, enabled: !(party && party.enabled)})
+        },
+
+        transfer(event) {
+            if (event.target.value == "") {
+                return
+            }
+
+            this.$store.dispatch("transfer", {player: this.$route.params.player, to: event.target.value})
+            this.$router.push("/player/"+event.target.value)
         }
     },
 
     computed: {
+        frame() {
+            return this.watchingDisplay ? this.$store.state.displays[this.watchingDisplay] : null
+        },
+
+        otherPlayers() {
+            return this.$store.state.players.filter(v => {return v.id != this.$route.params.player})
+        },
+
+        partyTitle() {
+            party = this.playerState.party
+            if (!party || !party.enabled) {
+                return "Party mode"
+            }
+
+            return party.host ? "Party mode (you are the host)" : "Party mode (skipping takes a vote)"
+        },
+
         playerState() {
             s = this.$store.getters.playerState(this.$route.params.player)
 
@@ -2,13 +2,15 @@ const store = Vuex.createStore({
     state() {
         return {
             playlists: [
-                { id: "LM", title: "Your Likes", count: "Some", thumbnail: "https://www.gstatic.com/youtube/media/ytm/images/pbg/liked-songs-@576.png" },
+                { id: "LM", title: "Your Likes", trackCount: "Some", thumbnail: "https://www.gstatic.com/youtube/media/ytm/images/pbg/liked-songs-@576.png" },
             ],
             currentPlaylist: {},
+            history: [],
 
             players: [],
             ws: null,
             wsFailed: false,
+            displays: {},
         }
     },
 
@@ -26,11 +28,17 @@ const store = Vuex.createStore({
         currentPlaylist(state, list) {
             state.currentPlaylist = list
         },
+        history(state, history) {
+            state.history = history
+        },
 
         playerState(state, player) {
             state.players = state.players.filter((e) => {return e.id != player.id})
             state.players.push(player)
         },
+        displayFrame(state, frame) {
+            state.displays[frame.player] = frame
+        },
         ws(state, ws) {
             state.ws = ws
         },
@@ -41,19 +49,26 @@ const store = Vuex.createStore({
     actions: {
         // HTTP GETs
         updatePlaylists(context) {
-            fetch("/api/library/playlists").then((resp) => {
+            fetch("http://"+window.location.hostname+":9001/catalog/playlists").then((resp) => {
                 return resp.json()
             }).then((resp) => {
                 context.commit("playlists", resp)
             })
         },
         getPlaylist(context, id) {
-            fetch("/api/playlist/"+id+"?limit=30").then((resp) => {
+            fetch("http://"+window.location.hostname+":9001/catalog/playlist/"+encodeURIComponent(id)+"?limit=30").then((resp) => {
                 return resp.json()
             }).then((resp) => {
                 context.commit("currentPlaylist", resp)
             })
         },
+        getHistory(context, player) {
+            fetch("http://"+window.location.hostname+":9001/history?limit=50&player="+encodeURIComponent(player)).then((resp) => {
+                return resp.json()
+            }).then((resp) => {
+                context.commit("history", resp.entries)
+            })
+        },
 
         // WS Sends
         playSong(context, e) {
@@ -67,6 +82,9 @@ const store = Vuex.createStore({
         setVolume(context, e) {
             context.state.ws.send(JSON.stringify({type: "VOLUME", player: e.player, data: e.volume}))
         },
+        setDSP(context, e) {
+            context.state.ws.send(JSON.stringify({type: "DSP", player: e.player, data: e.dsp}))
+        },
         nextSong(context, player) {
             context.state.ws.send(JSON.stringify({type: "NEXT", player: player}))
         },
@@ -75,6 +93,72 @@ const store = Vuex.createStore({
         },
         pauseSong(context, player) {
             context.state.ws.send(JSON.stringify({type: "PAUSE", player: player}))
+        },
+        toggleLyrics(context, player) {
+            context.state.ws.send(JSON.stringify({type: "LYRICS", player: player}))
+        },
+        enqueue(context, e) {
+            data = {queueType: "song", queueId: e.song.videoId, song: e.song}
+            context.state.ws.send(JSON.stringify({type: e.next ? "PLAY_NEXT" : "ENQUEUE", player: e.player, data: data}))
+        },
+        removeFromQueue(context, e) {
+            data = {index: e.index, videoId: e.videoId}
+            context.state.ws.send(JSON.stringify({type: "REMOVE", player: e.player, data: data}))
+        },
+        moveInQueue(context, e) {
+            data = {from: e.from, to: e.to, videoId: e.videoId}
+            context.state.ws.send(JSON.stringify({type: "MOVE", player: e.player, data: data}))
+        },
+        clearQueue(context, player) {
+            context.state.ws.send(JSON.stringify({type: "CLEAR", player: player}))
+        },
+        toggleShuffle(context, player) {
+            context.state.ws.send(JSON.stringify({type: "SHUFFLE", player: player}))
+        },
+        cycleRepeat(context, player) {
+            context.state.ws.send(JSON.stringify({type: "REPEAT", player: player}))
+        },
+        transfer(context, e) {
+            context.state.ws.send(JSON.stringify({type: "TRANSFER", player: e.player, data: {to: e.to}}))
+        },
+        toggleAutoplay(context, player) {
+            context.state.ws.send(JSON.stringify({type: "AUTOPLAY", player: player}))
+        },
+        toggleProgress(context, player) {
+            context.state.ws.send(JSON.stringify({type: "PROGRESS", player: player}))
+        },
+        setTemplate(context, e) {
+            context.state.ws.send(JSON.stringify({type: "TEMPLATE", player: e.player, data: {layout: e.layout, template: e.template}}))
+        },
+        setLayout(context, e) {
+            context.state.ws.send(JSON.stringify({type: "LAYOUT", player: e.player, data: e.layout}))
+        },
+        watchDisplay(context, e) {
+            context.state.ws.send(JSON.stringify({type: "DISPLAY", player: e.player, data: e.on}))
+        },
+        toggleParty(context, e) {
+            context.state.ws.send(JSON.stringify({type: "PARTY", player: e.player, data: {enabled: e.enabled}}))
+        },
+        keepPartyToken(context, e) {
+            // Keep the tokens of parties we started across reloads, so we stay the host
+            tokens = JSON.parse(localStorage.getItem("partyTokens") || "{}")
+            tokens[e.player] = e.token
+            localStorage.setItem("partyTokens", JSON.stringify(tokens))
+        },
+        identify(context) {
+            // Keep the same id across reloads, so the server logs can follow us
+            id = localStorage.getItem("clientId")
+            if (id == null) {
+                id = Math.random().toString(16).slice(2) + Math.random().toString(16).slice(2)
+                localStorage.setItem("clientId", id)
+            }
+
+            tokens = JSON.parse(localStorage.getItem("partyTokens") || "{}")
+            context.state.ws.send(JSON.stringify({type: "IDENTIFY", data: {id: id, name: navigator.userAgent, tokens: tokens}}))
+        },
+        attach(context, player) {
+            // Tell the server which player we're looking at, so we count towards its votes
+            context.state.ws.send(JSON.stringify({type: "ATTACH", player: player}))
         }
     },
     getters: {
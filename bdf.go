@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseBDF reads a BDF font. Glyphs are placed on the font's baseline, and are as
+// wide as they advance, so double width characters stay double width.
+func parseBDF(b []byte) (map[rune]bitmap, error) {
+	var fontW, fontH, fontX, fontY int
+	haveBox := false
+
+	glyphs := make(map[rune]bitmap)
+
+	var encoding, advance int
+	var bbx [4]int
+	var rows []string
+	inBitmap := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if inBitmap && fields[0] != "ENDCHAR" {
+			rows = append(rows, fields[0])
+			continue
+		}
+
+		var err error
+		switch fields[0] {
+		case "FONTBOUNDINGBOX":
+			var v []int
+			v, err = bdfInts(fields, 4)
+			if err == nil {
+				err = bdfBox(v, 1)
+			}
+			if err == nil {
+				fontW, fontH, fontX, fontY = v[0], v[1], v[2], v[3]
+				haveBox = true
+			}
+
+		case "STARTCHAR":
+			encoding, advance, bbx, rows = -1, 0, [4]int{}, nil
+
+		case "ENCODING":
+			var v []int
+			v, err = bdfInts(fields, 1)
+			if err == nil {
+				encoding = v[0]
+			}
+
+		case "DWIDTH":
+			var v []int
+			v, err = bdfInts(fields, 1)
+			if err == nil && (v[0] < 0 || v[0] > MAX_GLYPH_SIZE) {
+				err = fmt.Errorf("invalid DWIDTH %d", v[0])
+			}
+			if err == nil {
+				advance = v[0]
+			}
+
+		case "BBX":
+			var v []int
+			v, err = bdfInts(fields, 4)
+			if err == nil {
+				err = bdfBox(v, 0)
+			}
+			if err == nil {
+				copy(bbx[:], v)
+			}
+
+		case "BITMAP":
+			if !haveBox {
+				return nil, errors.New("bdf font has no FONTBOUNDINGBOX")
+			}
+			inBitmap = true
+
+		case "ENDCHAR":
+			inBitmap = false
+			if encoding < 0 {
+				// Glyphs that aren't in unicode can't be looked up anyway
+				continue
+			}
+
+			var g bitmap
+			g, err = bdfGlyph(rows, advance, bbx, fontW, fontH, fontX, fontY)
+			if err == nil {
+				glyphs[rune(encoding)] = g
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+
+	return glyphs, scanner.Err()
+}
+
+// bdfInts parses the first n numbers after a keyword
+func bdfInts(fields []string, n int) ([]int, error) {
+	if len(fields) < n+1 {
+		return nil, fmt.Errorf("%v needs %d values", fields[0], n)
+	}
+
+	v := make([]int, n)
+	for k := range v {
+		var err error
+		v[k], err = strconv.Atoi(fields[k+1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// bdfBox checks the size and offset of a bounding box, so a broken font can't ask for huge glyphs
+func bdfBox(v []int, minSize int) error {
+	for k, n := range v {
+		if (k < 2 && n < minSize) || n > MAX_GLYPH_SIZE || n < -MAX_GLYPH_SIZE {
+			return fmt.Errorf("invalid bounding box %v", v)
+		}
+	}
+
+	return nil
+}
+
+// bdfGlyph draws a glyph's rows of hex in a box the height of the font
+func bdfGlyph(rows []string, advance int, bbx [4]int, fontW, fontH, fontX, fontY int) (bitmap, error) {
+	w, h, x, y := bbx[0], bbx[1], bbx[2], bbx[3]
+	if len(rows) != h {
+		return bitmap{}, fmt.Errorf("glyph has %d rows instead of %d", len(rows), h)
+	}
+
+	if advance <= 0 {
+		advance = fontW
+	}
+
+	// The baseline is fontY above the bottom of the font's box
+	ascent := fontH + fontY
+	g := newBitmap(advance, fontH)
+	for k, v := range rows {
+		row, err := hex.DecodeString(v)
+		if err != nil {
+			return bitmap{}, err
+		}
+
+		for px := 0; px < w && px/8 < len(row); px++ {
+			if row[px/8]&(0x80>>(px%8)) != 0 {
+				g.set(px+x-fontX, ascent-(h+y)+k)
+			}
+		}
+	}
+
+	return g, nil
+}
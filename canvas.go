@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// canvas is a 1-bit image to draw a display on. Drawing is limited to the clip
+// rectangle, which is the whole canvas unless set. Canvases sent to be rendered
+// mustn't be drawn on afterwards, so draw on a clone instead.
+type canvas struct {
+	Width  int
+	Height int
+
+	pix  []bool
+	clip image.Rectangle
+}
+
+func newCanvas(width, height int) *canvas {
+	return &canvas{
+		Width:  width,
+		Height: height,
+		pix:    make([]bool, width*height),
+		clip:   image.Rect(0, 0, width, height),
+	}
+}
+
+// Bounds returns the whole canvas
+func (c *canvas) Bounds() image.Rectangle {
+	return image.Rect(0, 0, c.Width, c.Height)
+}
+
+// Clone returns a copy of the canvas that can be drawn on
+func (c *canvas) Clone() *canvas {
+	clone := *c
+	clone.pix = append([]bool{}, c.pix...)
+	return &clone
+}
+
+// SetClip limits drawing to part of the canvas
+func (c *canvas) SetClip(r image.Rectangle) {
+	c.clip = r.Intersect(c.Bounds())
+}
+
+// ResetClip allows drawing on the whole canvas again
+func (c *canvas) ResetClip() {
+	c.clip = c.Bounds()
+}
+
+// Set turns a pixel on or off, if it is in the clip rectangle
+func (c *canvas) Set(x, y int, on bool) {
+	if !image.Pt(x, y).In(c.clip) {
+		return
+	}
+
+	c.pix[y*c.Width+x] = on
+}
+
+// Get returns whether a pixel is on. Pixels off the canvas are off
+func (c *canvas) Get(x, y int) bool {
+	if !image.Pt(x, y).In(c.Bounds()) {
+		return false
+	}
+
+	return c.pix[y*c.Width+x]
+}
+
+// Clear turns off every pixel in the clip rectangle
+func (c *canvas) Clear() {
+	c.FillRect(c.clip, false)
+}
+
+// Line draws a line between two points, including both of them
+func (c *canvas) Line(x0, y0, x1, y1 int, on bool) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	// Bresenham's algorithm
+	err := dx + dy
+	for {
+		c.Set(x0, y0, on)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+// Rect draws the outline of a rectangle
+func (c *canvas) Rect(r image.Rectangle, on bool) {
+	r = r.Canon()
+	if r.Empty() {
+		return
+	}
+
+	c.Line(r.Min.X, r.Min.Y, r.Max.X-1, r.Min.Y, on)
+	c.Line(r.Min.X, r.Max.Y-1, r.Max.X-1, r.Max.Y-1, on)
+	c.Line(r.Min.X, r.Min.Y, r.Min.X, r.Max.Y-1, on)
+	c.Line(r.Max.X-1, r.Min.Y, r.Max.X-1, r.Max.Y-1, on)
+}
+
+// FillRect turns every pixel in a rectangle on or off
+func (c *canvas) FillRect(r image.Rectangle, on bool) {
+	r = r.Canon().Intersect(c.clip)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.pix[y*c.Width+x] = on
+		}
+	}
+}
+
+// Bitmap draws the pixels that are on in a bitmap, with its top left at x, y
+func (c *canvas) Bitmap(x, y int, b bitmap) {
+	for by := 0; by < b.height; by++ {
+		for bx := 0; bx < b.width; bx++ {
+			if b.px[by*b.width+bx] {
+				c.Set(x+bx, y+by, true)
+			}
+		}
+	}
+}
+
+// Blit copies a w by h area of src from sx, sy to x, y, including the pixels that are off
+func (c *canvas) Blit(src *canvas, sx, sy, x, y, w, h int) {
+	for dy := 0; dy < h; dy++ {
+		for dx := 0; dx < w; dx++ {
+			c.Set(x+dx, y+dy, src.Get(sx+dx, sy+dy))
+		}
+	}
+}
+
+// Text draws text in a font with its top left at x, y, returning how wide it is
+func (c *canvas) Text(x, y int, font *displayFont, text string) int {
+	cells := font.cells(text)
+	rowBytes := (font.Width + 7) / 8
+	for k, v := range cells {
+		for cy := 0; cy < font.Height; cy++ {
+			for cx := 0; cx < font.Width; cx++ {
+				if v[cy*rowBytes+cx/8]&(0x80>>(cx%8)) != 0 {
+					c.Set(x+k*font.Width+cx, y+cy, true)
+				}
+			}
+		}
+	}
+
+	return len(cells) * font.Width
+}
+
+// textWidth returns how wide text is in a font
+func textWidth(font *displayFont, text string) int {
+	return len(font.cells(text)) * font.Width
+}
+
+// encodeColumns packs a canvas a column at a time from the left, with the top pixel
+// of each column in the most significant bit. Both models' framebuffers are laid out this way.
+func encodeColumns(c *canvas) []byte {
+	bytesPerColumn := (c.Height + 7) / 8
+	buf := make([]byte, c.Width*bytesPerColumn)
+	for x := 0; x < c.Width; x++ {
+		for y := 0; y < c.Height; y++ {
+			if c.pix[y*c.Width+x] {
+				buf[x*bytesPerColumn+y/8] |= 0x80 >> (y % 8)
+			}
+		}
+	}
+
+	return buf
+}
+
+// decodeColumns unpacks a framebuffer laid out like encodeColumns
+func decodeColumns(buf []byte, width, height int) (*canvas, error) {
+	bytesPerColumn := (height + 7) / 8
+	if len(buf) != width*bytesPerColumn {
+		return nil, fmt.Errorf("framebuffer is %d bytes, not %d", len(buf), width*bytesPerColumn)
+	}
+
+	c := newCanvas(width, height)
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			c.pix[y*width+x] = buf[x*bytesPerColumn+y/8]&(0x80>>(y%8)) != 0
+		}
+	}
+
+	return c, nil
+}
+
+// encodeGrfd encodes a canvas for the Squeezebox 1's 280x16 display
+func encodeGrfd(c *canvas) ([]byte, error) {
+	if c.Width != SB1_DISPLAY_WIDTH || c.Height != SB1_DISPLAY_HEIGHT {
+		return nil, fmt.Errorf("canvas is %dx%d, not %dx%d", c.Width, c.Height, SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT)
+	}
+
+	return encodeColumns(c), nil
+}
+
+// encodeGrfe encodes a canvas for the Squeezebox 2's 320x32 display
+func encodeGrfe(c *canvas) ([]byte, error) {
+	if c.Width != SB2_DISPLAY_WIDTH || c.Height != SB2_DISPLAY_HEIGHT {
+		return nil, fmt.Errorf("canvas is %dx%d, not %dx%d", c.Width, c.Height, SB2_DISPLAY_WIDTH, SB2_DISPLAY_HEIGHT)
+	}
+
+	return encodeColumns(c), nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestColumnEncoders(t *testing.T) {
+	type pixel struct{ x, y int }
+
+	for _, v := range []struct {
+		name   string
+		encode func(*canvas) ([]byte, error)
+		width  int
+		height int
+		pixels []pixel
+		want   map[int]byte // Bytes expected to be set, by offset
+	}{
+		{"grfd blank", encodeGrfd, SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, nil, nil},
+		{"grfd top left", encodeGrfd, SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, []pixel{{0, 0}}, map[int]byte{0: 0x80}},
+		{"grfd second byte", encodeGrfd, SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, []pixel{{0, 8}, {0, 15}}, map[int]byte{1: 0x81}},
+		{"grfd next column", encodeGrfd, SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, []pixel{{1, 7}}, map[int]byte{2: 0x01}},
+		{"grfd bottom right", encodeGrfd, SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, []pixel{{279, 15}}, map[int]byte{559: 0x01}},
+		{"grfe top left", encodeGrfe, SB2_DISPLAY_WIDTH, SB2_DISPLAY_HEIGHT, []pixel{{0, 0}}, map[int]byte{0: 0x80}},
+		{"grfe column", encodeGrfe, SB2_DISPLAY_WIDTH, SB2_DISPLAY_HEIGHT, []pixel{{2, 0}, {2, 9}, {2, 18}, {2, 27}}, map[int]byte{8: 0x80, 9: 0x40, 10: 0x20, 11: 0x10}},
+		{"grfe bottom right", encodeGrfe, SB2_DISPLAY_WIDTH, SB2_DISPLAY_HEIGHT, []pixel{{319, 31}}, map[int]byte{1279: 0x01}},
+	} {
+		c := newCanvas(v.width, v.height)
+		for _, p := range v.pixels {
+			c.Set(p.x, p.y, true)
+		}
+
+		got, err := v.encode(c)
+		if err != nil {
+			t.Errorf("%v: %v", v.name, err)
+			continue
+		}
+
+		want := make([]byte, v.width*v.height/8)
+		for k, b := range v.want {
+			want[k] = b
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: encoded %x", v.name, got)
+			continue
+		}
+
+		// Which decodes back to the same pixels
+		decoded, err := decodeColumns(got, v.width, v.height)
+		if err != nil || !equalPixels(decoded, c) {
+			t.Errorf("%v: decoded differently, %v", v.name, err)
+		}
+	}
+}
+
+func TestColumnEncodersCheckSize(t *testing.T) {
+	for _, v := range []struct {
+		name   string
+		encode func(*canvas) ([]byte, error)
+		c      *canvas
+	}{
+		{"grfd given grfe size", encodeGrfd, newCanvas(SB2_DISPLAY_WIDTH, SB2_DISPLAY_HEIGHT)},
+		{"grfe given grfd size", encodeGrfe, newCanvas(SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT)},
+		{"grfe too narrow", encodeGrfe, newCanvas(SB2_DISPLAY_WIDTH-1, SB2_DISPLAY_HEIGHT)},
+	} {
+		if _, err := v.encode(v.c); err == nil {
+			t.Errorf("%v: encoded a %vx%v canvas", v.name, v.c.Width, v.c.Height)
+		}
+	}
+
+	if _, err := decodeColumns(make([]byte, 10), SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT); err == nil {
+		t.Error("decoded a short framebuffer")
+	}
+}
+
+func equalPixels(a, b *canvas) bool {
+	if a.Width != b.Width || a.Height != b.Height {
+		return false
+	}
+	for k := range a.pix {
+		if a.pix[k] != b.pix[k] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The id of the liked songs, which every catalog treats as a playlist
+const LIKED_PLAYLIST = "LM"
+
+// Catalog is where music and information about it comes from
+type Catalog interface {
+	// Browse returns the playlists in the library, without their tracks
+	Browse() ([]Playlist, error)
+
+	// Playlist returns count tracks of a playlist from start, or all of them if count is 0.
+	// TrackCount is the total number of tracks, or 0 if it isn't known.
+	Playlist(id string, start int, count int) (Playlist, error)
+
+	Album(id string) ([]Song, error)
+	Artist(id string) ([]Song, error) // The artist's top songs
+	Search(query string) ([]Song, error)
+	Related(videoID string) ([]Song, error)
+	Song(videoID string) (Song, error)
+}
+
+// localStreamer is implemented by catalogs that play songs from files rather than youtube
+type localStreamer interface {
+	LocalPath(videoID string) (string, bool)
+}
+
+type Playlist struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Thumbnail  string `json:"thumbnail"`
+	TrackCount int    `json:"trackCount"`
+	Duration   string `json:"duration,omitempty"`
+	Tracks     []Song `json:"tracks,omitempty"`
+}
+
+// CatalogConfig picks the catalog in the persistent data
+type CatalogConfig struct {
+	Type string `json:"type"` // ytm (the default), local or fake
+	URL  string `json:"url"`  // The api of the python server for ytm
+	Path string `json:"path"` // The music directory for local, or the fixture file for fake
+}
+
+var catalog Catalog
+
+// newCatalog creates the catalog described by the config
+func newCatalog(c CatalogConfig) (Catalog, error) {
+	switch c.Type {
+	case "", "ytm":
+		url := c.URL
+		if url == "" {
+			url = DEFAULT_YTM_API
+		}
+
+		return ytmCatalog{api: strings.TrimSuffix(url, "/")}, nil
+
+	case "local":
+		if c.Path == "" {
+			return nil, errors.New("the local catalog needs a path to the music")
+		}
+
+		return newLocalCatalog(c.Path)
+
+	case "fake":
+		if c.Path == "" {
+			return nil, errors.New("the fake catalog needs a path to a fixture")
+		}
+
+		return newFakeCatalog(c.Path)
+
+	default:
+		return nil, fmt.Errorf("unknown catalog type %q", c.Type)
+	}
+}
+
+// pageOf returns count songs from start, or all of them from start if count is 0
+func pageOf(songs []Song, start int, count int) []Song {
+	if start > len(songs) {
+		start = len(songs)
+	}
+
+	end := len(songs)
+	if count > 0 && start+count < end {
+		end = start + count
+	}
+
+	return songs[start:end]
+}
+
+// searchSongs returns the songs whose title, artists or album contain every word of the query
+func searchSongs(songs []Song, query string) []Song {
+	words := strings.Fields(strings.ToLower(query))
+
+	matches := []Song{}
+	for _, v := range songs {
+		text := strings.ToLower(v.Title + " " + v.Album.Name)
+		for _, a := range v.Artists {
+			text += " " + strings.ToLower(a.Name)
+		}
+
+		found := true
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			matches = append(matches, v)
+		}
+	}
+
+	return matches
+}
+
+// getPlaylist retrieves all the tracks in a playlist
+func getPlaylist(playlistID string) ([]Song, error) {
+	p, err := catalog.Playlist(playlistID, 0, 0)
+	return p.Tracks, err
+}
+
+// resolveSongs retrieves the songs for a queue type: a song, album, artist, playlist,
+// the liked songs or a search, where the id is the query. Songs may be given in full,
+// otherwise their metadata is looked up from the id.
+func resolveSongs(queueType string, queueID string, song json.RawMessage) ([]Song, error) {
+	switch queueType {
+	case "song":
+		if len(song) > 0 && string(song) != "null" {
+			var s Song
+			err := json.Unmarshal(song, &s)
+			if err != nil {
+				return nil, err
+			}
+
+			return []Song{s}, nil
+		}
+
+		s, err := catalog.Song(queueID)
+		if err != nil {
+			return nil, err
+		}
+
+		return []Song{s}, nil
+
+	case "album":
+		return catalog.Album(queueID)
+
+	case "artist":
+		return catalog.Artist(queueID)
+
+	case "playlist":
+		return getPlaylist(queueID)
+
+	case "liked":
+		return getPlaylist(LIKED_PLAYLIST)
+
+	case "search":
+		if strings.TrimSpace(queueID) == "" {
+			return nil, errors.New("empty search")
+		}
+
+		return catalog.Search(queueID)
+
+	default:
+		return nil, fmt.Errorf("unknown queue type %q", queueType)
+	}
+}
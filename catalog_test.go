@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useCatalog sets the catalog for the test, putting the old one back afterwards
+func useCatalog(t *testing.T, c Catalog) {
+	t.Helper()
+
+	old := catalog
+	catalog = c
+	t.Cleanup(func() { catalog = old })
+}
+
+// The fixture in the repository, found before tests change directory
+var fixturePath, _ = filepath.Abs(filepath.Join("fixtures", "catalog.json"))
+
+// useFixture loads the fake catalog from the fixture
+func useFixture(t *testing.T) *fakeCatalog {
+	t.Helper()
+
+	f, err := newFakeCatalog(fixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useCatalog(t, f)
+
+	return f
+}
+
+// useBigPlaylist loads a fake catalog with a playlist "big" of n songs, which takes several
+// pages, and an album "small" of the first two
+func useBigPlaylist(t *testing.T, n int) *fakeCatalog {
+	t.Helper()
+
+	var ids []string
+	songs := testSongs("big", n)
+	for _, v := range songs {
+		ids = append(ids, v.ID)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"songs":     songs,
+		"playlists": []map[string]interface{}{{"id": "big", "title": "Big", "tracks": ids}},
+		"albums":    map[string][]string{"small": ids[:2]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFakeCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useCatalog(t, f)
+
+	return f
+}
+
+// unknownTotal hides how many songs are in playlists, like catalogs that don't know
+type unknownTotal struct {
+	Catalog
+}
+
+func (u unknownTotal) Playlist(id string, start int, count int) (Playlist, error) {
+	p, err := u.Catalog.Playlist(id, start, count)
+	p.TrackCount = 0
+	return p, err
+}
+
+func songIDs(songs []Song) string {
+	var ids []string
+	for _, v := range songs {
+		ids = append(ids, v.ID)
+	}
+
+	return fmt.Sprint(ids)
+}
+
+func TestResolveSongs(t *testing.T) {
+	useFixture(t)
+
+	tests := []struct {
+		queueType string
+		id        string
+		song      string
+		want      string
+	}{
+		{"song", "kJQP7kiw5Fk", "", "[kJQP7kiw5Fk]"},
+		{"song", "", `{"videoId": "abc", "title": "Given in full"}`, "[abc]"},
+		{"album", "vida", "", "[kJQP7kiw5Fk]"},
+		{"artist", "rick", "", "[dQw4w9WgXcQ]"},
+		{"playlist", "fixture", "", "[dQw4w9WgXcQ kJQP7kiw5Fk]"},
+		{"liked", "", "", "[dQw4w9WgXcQ]"},
+		{"search", "daddy yankee", "", "[kJQP7kiw5Fk]"},
+	}
+
+	for _, v := range tests {
+		songs, err := resolveSongs(v.queueType, v.id, json.RawMessage(v.song))
+		if err != nil {
+			t.Errorf("%v %q: %v", v.queueType, v.id, err)
+			continue
+		}
+
+		if got := songIDs(songs); got != v.want {
+			t.Errorf("%v %q: got %v, want %v", v.queueType, v.id, got, v.want)
+		}
+	}
+
+	for _, v := range [][2]string{{"album", "missing"}, {"song", "missing"}, {"search", " "}, {"unknown", "x"}} {
+		_, err := resolveSongs(v[0], v[1], nil)
+		if err == nil {
+			t.Errorf("%v %q: expected an error", v[0], v[1])
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	useBigPlaylist(t, 250)
+
+	songs, pages, err := firstPage("playlist", "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != PAGE_SIZE || songs[0].ID != "big0" || pages.Next != PAGE_SIZE || pages.Total != 250 || !pages.More() {
+		t.Fatalf("first page has %v songs, next %v of %v", len(songs), pages.Next, pages.Total)
+	}
+
+	page, total, err := getPage("playlist", "big", 200, PAGE_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 50 || page[0].ID != "big200" || total != 250 {
+		t.Fatalf("last page has %v songs from %v, of %v", len(page), page[0].ID, total)
+	}
+
+	// Pages are loaded until the video turns up
+	songs, pages, err = pagesUntil("playlist", "big", "big150")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 200 || pages.Next != 200 {
+		t.Fatalf("loaded %v songs up to %v, want 200", len(songs), pages.Next)
+	}
+
+	// Or until there are none left
+	songs, pages, err = pagesUntil("playlist", "big", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 250 || pages.More() {
+		t.Fatalf("loaded %v songs, with more %v", len(songs), pages.More())
+	}
+}
+
+func TestPagesWithoutTotal(t *testing.T) {
+	f := useBigPlaylist(t, 150)
+	useCatalog(t, unknownTotal{f})
+
+	songs, pages, err := firstPage("playlist", "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != PAGE_SIZE || !pages.More() {
+		t.Fatalf("first page has %v songs, with more %v", len(songs), pages.More())
+	}
+
+	// The short page is the last
+	songs, pages, err = pages.fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 50 || pages.More() {
+		t.Fatalf("second page has %v songs, with more %v", len(songs), pages.More())
+	}
+}
+
+func TestPageRetryBacksOff(t *testing.T) {
+	p := PageLoader{QueueType: "playlist", ID: "big"}
+
+	var delays []time.Duration
+	for i := 0; i < 10; i++ {
+		p = p.failed()
+		delays = append(delays, time.Until(p.retryAt).Round(time.Second))
+	}
+
+	if delays[0] != PAGE_RETRY_MIN || delays[1] != 2*PAGE_RETRY_MIN || delays[9] != PAGE_RETRY_MAX {
+		t.Fatalf("retried after %v", delays)
+	}
+}
+
+func TestPlaySongs(t *testing.T) {
+	testEnv(t)
+	useBigPlaylist(t, 250)
+	q, _ := newTestQueue(t, "play")
+	c := &Client{}
+
+	// A start song in a later page plays from where it is in the playlist
+	start, _ := json.Marshal(Song{ID: "big150"})
+	c.PlaySongs(q, PlayEvent{QueueType: "playlist", QueueID: "big", StartSong: start})
+
+	st := q.State()
+	song, _ := st.CurrentSong()
+	if song.ID != "big150" || st.Index != 150 || len(st.Songs) != 200 || st.Pages.Next != 200 || st.TotalHint() != 250 {
+		t.Fatalf("playing %v at %v of %v songs, next page at %v", song.ID, st.Index, len(st.Songs), st.Pages.Next)
+	}
+
+	// Songs that don't include the start song play it first
+	start, _ = json.Marshal(Song{ID: "elsewhere"})
+	c.PlaySongs(q, PlayEvent{QueueType: "album", QueueID: "small", StartSong: start})
+
+	st = q.State()
+	if got := songIDs(st.Songs); got != "[elsewhere big0 big1]" || st.Index != 0 || st.Pages.More() {
+		t.Fatalf("queue is %v at %v", got, st.Index)
+	}
+
+	// Failing to load leaves the queue alone
+	c.PlaySongs(q, PlayEvent{QueueType: "playlist", QueueID: "missing"})
+	if got := songIDs(q.State().Songs); got != "[elsewhere big0 big1]" {
+		t.Fatalf("queue changed to %v", got)
+	}
+}
+
+func TestLoadVidIDPages(t *testing.T) {
+	testEnv(t)
+	useBigPlaylist(t, 250)
+	q, _ := newTestQueue(t, "load")
+	addQueue(q)
+	t.Cleanup(func() { removeQueue(q) })
+
+	load := func(refs string) {
+		w := httptest.NewRecorder()
+		loadVidID(w, httptest.NewRequest("POST", "/load?player=load&vid="+url.QueryEscape(refs), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("load returned %v: %v", w.Code, w.Body)
+		}
+	}
+
+	// A playlist at the end has its first page queued, and the rest loaded later
+	load("https://music.youtube.com/playlist?list=big")
+	st := q.State()
+	if len(st.Songs) != PAGE_SIZE || st.Pages.Next != PAGE_SIZE || st.TotalHint() != 250 {
+		t.Fatalf("queued %v songs of %v, next page at %v", len(st.Songs), st.TotalHint(), st.Pages.Next)
+	}
+
+	// Earlier playlists are loaded in full, so songs after them stay in order. The
+	// video isn't in the catalog, which doesn't stop the playlist being queued.
+	load("https://music.youtube.com/playlist?list=big,dQw4w9WgXcQ")
+	st = q.State()
+	if len(st.Songs) != 250 || st.Songs[249].ID != "big249" || st.Pages.More() {
+		t.Fatalf("queued %v songs, with more %v", len(st.Songs), st.Pages.More())
+	}
+}
+
+func TestEnqueueSongsPages(t *testing.T) {
+	testEnv(t)
+	useBigPlaylist(t, 250)
+	q, _ := newTestQueue(t, "enqueue")
+
+	// A playlist added to the end is loaded a page at a time
+	err := enqueueSongs(q, EnqueueEvent{QueueType: "playlist", QueueID: "big"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := q.State()
+	if len(st.Songs) != PAGE_SIZE || st.Pages.Next != PAGE_SIZE || st.TotalHint() != 250 {
+		t.Fatalf("queued %v songs of %v", len(st.Songs), st.TotalHint())
+	}
+
+	// Another while that one is still loading is added in full, leaving the pages alone
+	err = enqueueSongs(q, EnqueueEvent{QueueType: "playlist", QueueID: "big"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = q.State()
+	if len(st.Songs) != PAGE_SIZE+250 || st.Pages.Next != PAGE_SIZE || st.Songs[1].ID != "big0" || st.Songs[250].ID != "big249" {
+		t.Fatalf("queued %v songs, next page at %v", len(st.Songs), st.Pages.Next)
+	}
+
+	err = enqueueSongs(q, EnqueueEvent{QueueType: "playlist", QueueID: "missing"}, false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"math/rand"
-	"net/http"
+	"errors"
+	"sync"
+	"time"
 
-	"github.com/Jeffail/gabs/v2"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -22,36 +24,317 @@ type PlayEvent struct {
 	QueueID   string          `json:"queueId"`
 	StartSong json.RawMessage `json:"startSong"`
 	Shuffle   bool            `json:"shuffle"`
+	Radio     bool            `json:"radio"` // Follow a song with related songs
 }
 
+// EnqueueEvent adds a song, album or playlist to the queue
+type EnqueueEvent struct {
+	QueueType string          `json:"queueType"`
+	QueueID   string          `json:"queueId"`
+	Song      json.RawMessage `json:"song"`
+}
+
+// QueueEditEvent removes or moves a song in the queue. The video id is optional,
+// and stops the edit if the queue has changed underneath the client.
+type QueueEditEvent struct {
+	Index   int    `json:"index"`
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	VideoID string `json:"videoId"`
+}
+
+// TransferEvent moves the queue to another player, given by id or name
+type TransferEvent struct {
+	To string `json:"to"`
+}
+
+// How many messages can be waiting to be sent to a client before they are dropped
+const CLIENT_SEND_BUFFER = 64
+
 type Client struct {
-	Conn *websocket.Conn
+	Conn     *websocket.Conn
+	ID       string // Assigned by the server for each connection
+	Identity string // Chosen by the client when it identifies itself, which it can't change after. Protected by clientsMu
+	Name     string
+
+	send        chan []byte
+	loads       chan func()       // Songs being retrieved for the client, in the order it asked for them
+	displays    map[string]bool   // Players whose display is sent to the client. Protected by clientsMu
+	frames      map[string][]byte // The latest display frame waiting to be sent, by player id. Protected by clientsMu
+	framesReady chan struct{}     // Wakes the writer when there are frames waiting
+	hostTokens  map[string]string // Tokens of the parties the client is host of, by player id. Protected by clientsMu
+	player      string            // The player the client is looking at. Protected by clientsMu
+}
+
+// TemplateEvent sets the now playing template for a layout, or resets it if empty
+type TemplateEvent struct {
+	Layout   string `json:"layout"`
+	Template string `json:"template"`
+}
+
+// IdentifyEvent tells the server who a client is, and the tokens of parties it started. The id
+// is only used to tell clients apart in logs, as the client chooses it
+type IdentifyEvent struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Tokens map[string]string `json:"tokens"` // Host tokens by player id
 }
 
+// The longest client id accepted
+const MAX_CLIENT_ID = 64
+
 var clients []*Client
+var clientsMu sync.Mutex
 
 var metricConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
 	Name: "slimytm_connected_clients",
 	Help: "The number of clients currently connected",
 })
 
+func newClient(conn *websocket.Conn) *Client {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &Client{Conn: conn, ID: hex.EncodeToString(id), send: make(chan []byte, CLIENT_SEND_BUFFER), framesReady: make(chan struct{}, 1)}
+}
+
+// addClient registers the client to receive updates
+func addClient(c *Client) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	clients = append(clients, c)
+	metricConnectedClients.Inc()
+}
+
+// removeClient unregisters the client, returning false if it was already removed
+func removeClient(c *Client) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for k, v := range clients {
+		if v == c {
+			clients = append(clients[:k:k], clients[k+1:]...)
+			close(c.send)
+			metricConnectedClients.Dec()
+			return true
+		}
+	}
+
+	return false
+}
+
+// allClients returns a copy of the registered clients
+func allClients() []*Client {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return append([]*Client(nil), clients...)
+}
+
+// identify records who the client says it is, returning false if it has already said it is someone else
+func (c *Client) identify(i IdentifyEvent) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c.Identity != "" && c.Identity != i.ID {
+		return false
+	}
+	c.Identity, c.Name = i.ID, i.Name
+	return true
+}
+
+// attach records the player the client is looking at, which its votes count towards in party
+// mode. Detaching from a player takes back any vote for it.
+func (c *Client) attach(playerID string) {
+	clientsMu.Lock()
+	old := c.player
+	c.player = playerID
+	clientsMu.Unlock()
+
+	if old == playerID {
+		return
+	}
+
+	// The votes needed have changed for both players
+	if q := getQueue(old); q != nil {
+		q.RemoveVote(c.ID)
+	}
+	if q := getQueue(playerID); q != nil {
+		q.UpdateClients()
+	}
+}
+
+// attachedTo returns whether the client has identified itself and is looking at a player
+func (c *Client) attachedTo(playerID string) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return c.Identity != "" && c.player == playerID
+}
+
+// attachedClients returns how many identified clients are looking at a player
+func attachedClients(playerID string) int {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	n := 0
+	for _, v := range clients {
+		if v.Identity != "" && v.player == playerID {
+			n++
+		}
+	}
+
+	return n
+}
+
+// load retrieves songs for the client off the listener, so other events aren't held up. Songs
+// are retrieved one request at a time, so they are added to queues in the order they were asked for.
+func (c *Client) load(f func()) {
+	select {
+	case c.loads <- f:
+	default:
+		logger.Warn("client is asking for too many songs, dropping request")
+	}
+}
+
+// sendToClient sends a message to one client. The client may have been removed, closing its channel
+func sendToClient(c *Client, msg []byte) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for _, v := range clients {
+		if v == c {
+			c.Send(msg)
+		}
+	}
+}
+
+// Send queues a message for the client without blocking. Must be called with clientsMu held
+func (c *Client) Send(msg []byte) {
+	select {
+	case c.send <- msg:
+	default:
+		logger.Warn("client is not keeping up, dropping message")
+	}
+}
+
+// SendFrame queues a display frame for the client, replacing any frame from the same player
+// that hasn't been sent yet. Frames don't take space from other messages, so those are never
+// dropped for them. Must be called with clientsMu held
+func (c *Client) SendFrame(playerID string, msg []byte) {
+	if c.frames == nil {
+		c.frames = make(map[string][]byte)
+	}
+	c.frames[playerID] = msg
+
+	select {
+	case c.framesReady <- struct{}{}:
+	default:
+	}
+}
+
+// takeFrames returns the display frames waiting to be sent, and forgets them
+func (c *Client) takeFrames() map[string][]byte {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	frames := c.frames
+	c.frames = nil
+	return frames
+}
+
+// Writer sends queued messages to the client. It is the only writer to the connection
+func (c *Client) Writer() {
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			c.write(msg)
+		case <-c.framesReady:
+			for _, v := range c.takeFrames() {
+				c.write(v)
+			}
+		}
+	}
+}
+
+func (c *Client) write(msg []byte) {
+	err := c.Conn.WriteMessage(websocket.TextMessage, msg)
+	if err != nil {
+		logger.Debugw("unable to write to client",
+			"err", err)
+	}
+}
+
 func (c *Client) Listener() {
+	defer removeClient(c)
+	defer c.attach("")
+
+	c.loads = make(chan func(), CLIENT_SEND_BUFFER)
+	defer close(c.loads)
+	go func() {
+		for f := range c.loads {
+			f()
+		}
+	}()
+
 	for {
 		var e Event
 		err := c.Conn.ReadJSON(&e)
 		if err != nil {
 			logger.Debugw("client disconnected",
 				"err", err)
-			metricConnectedClients.Dec()
 			return
 		}
 
-		// Find the correct queue
-		var queue *Queue
-		for _, v := range queues {
-			if v.Player.GetID() == e.Player {
-				queue = v
+		if e.Type == "IDENTIFY" {
+			var i IdentifyEvent
+			err := json.Unmarshal(e.Data, &i)
+			if err != nil || i.ID == "" || len(i.ID) > MAX_CLIENT_ID {
+				logger.Warnw("invalid identity from client",
+					"err", err)
+				continue
+			}
+
+			if !c.identify(i) {
+				logger.Warnw("client tried to change its identity",
+					"client", c.ID,
+					"identity", i.ID)
+				continue
 			}
+			c.setHostTokens(i.Tokens)
+			logger.Debugw("client identified",
+				"client", c.ID,
+				"identity", i.ID,
+				"name", i.Name)
+
+			// Let the client know which parties it is still the host of
+			for k := range i.Tokens {
+				if q := getQueue(k); q != nil {
+					q.UpdateClients()
+				}
+			}
+			continue
+		}
+
+		if e.Type == "ATTACH" {
+			c.attach(e.Player)
+			continue
+		}
+
+		// Find the correct queue
+		queue := getQueue(e.Player)
+		if queue == nil {
+			logger.Warnw("unknown player for event, dropping",
+				"player", e.Player,
+				"event", e.Type)
+			continue
+		}
+
+		// Guests at a party can only suggest songs and vote to skip
+		if party := queue.State().Party; party.isGuest(c.hostToken(queue.Player.GetID())) && e.Type != "PARTY" {
+			c.guestEvent(queue, e)
+			continue
 		}
 
 		if e.Type == "PLAY" {
@@ -63,13 +346,16 @@ func (c *Client) Listener() {
 				continue
 			}
 
-			c.PlaySongs(queue, p)
+			// Retrieving the songs can take a while, so don't hold up other events
+			c.load(func() { c.PlaySongs(queue, p) })
 		} else if e.Type == "NEXT" {
 			queue.Next()
 		} else if e.Type == "PREVIOUS" {
 			queue.Previous()
 		} else if e.Type == "PAUSE" {
 			queue.Pause()
+		} else if e.Type == "LYRICS" {
+			queue.ToggleLyrics()
 		} else if e.Type == "VOLUME" {
 			var v int
 			err := json.Unmarshal(e.Data, &v)
@@ -79,8 +365,169 @@ func (c *Client) Listener() {
 				continue
 			}
 
-			queue.Player.SetVolume(v)
-			queue.UpdateClients()
+			queue.SetVolume(v)
+		} else if e.Type == "DSP" {
+			var d DSPSettings
+			err := json.Unmarshal(e.Data, &d)
+			if err != nil {
+				logger.Warnw("unable to unmarshal event",
+					"err", err)
+				continue
+			}
+
+			queue.SetDSP(d)
+		} else if e.Type == "ENQUEUE" || e.Type == "PLAY_NEXT" {
+			var p EnqueueEvent
+			err := json.Unmarshal(e.Data, &p)
+			if err != nil {
+				logger.Warnw("unable to unmarshal event",
+					"err", err)
+				continue
+			}
+
+			next := e.Type == "PLAY_NEXT"
+			c.load(func() {
+				err := enqueueSongs(queue, p, next)
+				if err != nil {
+					logger.Errorw("unable to retrieve songs to enqueue",
+						"type", p.QueueType,
+						"id", p.QueueID,
+						"err", err)
+				}
+			})
+		} else if e.Type == "REMOVE" || e.Type == "MOVE" {
+			var p QueueEditEvent
+			err := json.Unmarshal(e.Data, &p)
+			if err != nil {
+				logger.Warnw("unable to unmarshal event",
+					"err", err)
+				continue
+			}
+
+			if e.Type == "REMOVE" {
+				err = queue.Remove(p.Index, p.VideoID)
+			} else {
+				err = queue.Move(p.From, p.To, p.VideoID)
+			}
+			if err != nil {
+				logger.Warnw("unable to edit queue",
+					"event", e.Type,
+					"err", err)
+			}
+		} else if e.Type == "CLEAR" {
+			queue.Clear()
+		} else if e.Type == "REPEAT" {
+			// A mode sets it, otherwise cycle through them
+			var mode string
+			json.Unmarshal(e.Data, &mode)
+			if mode == "" {
+				queue.CycleRepeat()
+				continue
+			}
+
+			m, err := parseRepeatMode(mode)
+			if err != nil {
+				logger.Warnw("unable to set repeat mode",
+					"err", err)
+				continue
+			}
+
+			queue.SetRepeat(m)
+		} else if e.Type == "TRANSFER" {
+			var t TransferEvent
+			err := json.Unmarshal(e.Data, &t)
+			if err != nil {
+				logger.Warnw("unable to unmarshal event",
+					"err", err)
+				continue
+			}
+
+			target := findQueue(t.To)
+			if target == nil {
+				logger.Warnw("unknown player to transfer to",
+					"player", t.To)
+				continue
+			}
+
+			err = transferQueue(queue, target)
+			if err != nil {
+				logger.Warnw("unable to transfer queue",
+					"err", err)
+			}
+		} else if e.Type == "PARTY" {
+			var p PartyEvent
+			err := json.Unmarshal(e.Data, &p)
+			if err != nil {
+				logger.Warnw("unable to unmarshal event",
+					"err", err)
+				continue
+			}
+
+			// Whoever starts the party is the host, and only they can change it
+			if party := queue.State().Party; party.isGuest(c.hostToken(queue.Player.GetID())) {
+				logger.Infow("only the host can change party mode",
+					"client", c.ID)
+				continue
+			}
+
+			c.startParty(queue, p)
+		} else if e.Type == "PROGRESS" {
+			// true or false sets it, otherwise toggle it
+			var on *bool
+			json.Unmarshal(e.Data, &on)
+			if on == nil {
+				queue.ToggleProgress()
+				continue
+			}
+
+			queue.SetProgress(*on)
+		} else if e.Type == "TEMPLATE" {
+			var t TemplateEvent
+			err := json.Unmarshal(e.Data, &t)
+			if err != nil {
+				logger.Warnw("unable to unmarshal event",
+					"err", err)
+				continue
+			}
+
+			err = queue.SetTemplate(t.Layout, t.Template)
+			if err != nil {
+				logger.Infow("unable to set display template",
+					"err", err)
+			}
+		} else if e.Type == "DISPLAY" {
+			// Start or stop watching the display
+			var on bool
+			json.Unmarshal(e.Data, &on)
+			c.watchDisplay(queue, on)
+		} else if e.Type == "LAYOUT" {
+			var layout string
+			json.Unmarshal(e.Data, &layout)
+			err := queue.SetLayout(layout)
+			if err != nil {
+				logger.Infow("unable to set layout",
+					"err", err)
+			}
+		} else if e.Type == "AUTOPLAY" {
+			// true or false sets it, otherwise toggle it
+			var on *bool
+			json.Unmarshal(e.Data, &on)
+			if on == nil {
+				queue.ToggleAutoplay()
+				continue
+			}
+
+			queue.SetAutoplay(*on)
+		} else if e.Type == "SHUFFLE" {
+			// true or false sets it, otherwise toggle it
+			var shuffle *bool
+			json.Unmarshal(e.Data, &shuffle)
+			if shuffle == nil {
+				queue.ToggleShuffle()
+				continue
+			}
+
+			queue.SetShuffle(*shuffle)
 		} else {
 			logger.Warnw("received unknown event from web client",
 				"event", e.Type)
@@ -88,78 +535,70 @@ func (c *Client) Listener() {
 	}
 }
 
+// PlaySongs replaces the queue with the songs for a play event, starting from its
+// start song. Everything is retrieved first, so the queue is left alone on errors.
 func (c *Client) PlaySongs(q *Queue, p PlayEvent) {
-	if q == nil {
-		logger.Warnw("unknown player for event, dropping")
-		return
-	}
-
-	// Add the start song to the queue
 	var startSong Song
-	err := json.Unmarshal(p.StartSong, &startSong)
-	if err != nil {
-		logger.Warnw("unable to unmarshal event",
-			"err", err)
-		return
-	}
-
-	q.Songs = []Song{startSong}
-	q.Index = -1
-	q.Next()
-
-	// Retrieve the rest of the songs and enqueue them
-	var songs []Song
-	switch p.QueueType {
-	case "playlist":
-		resp, err := http.Get("http://localhost:9000/api/playlist/" + p.QueueID)
-		if err != nil {
-			logger.Errorw("unable to retrieve playlist",
-				"err", err)
-			return
-		}
-
-		playlist, err := gabs.ParseJSONBuffer(resp.Body)
-		if err != nil {
-			logger.Errorw("unable to parse json playlist info",
-				"err", err)
-			return
-		}
-
-		err = json.Unmarshal(playlist.Path("tracks").Bytes(), &songs)
+	if len(p.StartSong) > 0 && string(p.StartSong) != "null" {
+		err := json.Unmarshal(p.StartSong, &startSong)
 		if err != nil {
-			logger.Errorw("unable to get tracks from playlist info",
+			logger.Warnw("unable to unmarshal event",
 				"err", err)
 			return
 		}
+	}
 
-	default:
-		logger.Warn("unknown queue type")
+	// Large playlists are loaded a page at a time
+	var songs []Song
+	var pages PageLoader
+	var err error
+	if pagedQueueType(p.QueueType) && startSong.ID != "" {
+		songs, pages, err = pagesUntil(p.QueueType, p.QueueID, startSong.ID)
+	} else if pagedQueueType(p.QueueType) {
+		songs, pages, err = firstPage(p.QueueType, p.QueueID)
+	} else {
+		songs, err = resolveSongs(p.QueueType, p.QueueID, p.StartSong)
+	}
+	if err == nil && p.QueueType == "song" && p.Radio && len(songs) > 0 {
+		var related []Song
+		related, err = catalog.Related(songs[0].ID)
+		songs = append(songs, related...)
+	}
+	if err == nil && len(songs) == 0 {
+		err = errors.New("nothing to play")
+	}
+	if err != nil {
+		logger.Errorw("unable to retrieve songs to play",
+			"type", p.QueueType,
+			"id", p.QueueID,
+			"err", err)
+		q.PushText("Unable to load "+p.QueueType, time.Second*3)
 		return
 	}
 
-	if p.Shuffle {
-		logger.Debug("shuffling playlist")
-		rand.Shuffle(len(songs), func(i, j int) { songs[i], songs[j] = songs[j], songs[i] })
-
-		// Remove the already playing song from the list
+	// Start from the start song, or put it first if the songs don't include it. Paged
+	// songs only leave it out once every page is loaded, so nothing comes after it.
+	index := 0
+	if startSong.ID != "" {
+		index = -1
 		for k, v := range songs {
 			if startSong.ID == v.ID {
-				songs = append(songs[:k], songs[k+1:]...)
+				index = k
 				break
 			}
 		}
 
-		q.Songs = append(q.Songs, songs...)
+		if index < 0 {
+			songs = append([]Song{startSong}, songs...)
+			index = 0
+		}
+	}
 
-	} else {
-		q.Songs = songs
+	q.ReplacePaged(songs, index, pages)
 
-		for k, v := range q.Songs {
-			// Set the queue index to the start song
-			if startSong.ID == v.ID {
-				q.Index = k
-				break
-			}
-		}
+	// Shuffling keeps the original order, so it can be turned off again
+	if p.Shuffle {
+		logger.Debug("shuffling queue")
+		q.SetShuffle(true)
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"time"
+)
+
+const (
+	SCROLL_HOLD = time.Second * 3 // How long text stays at its start before scrolling
+	SCROLL_STEP = 3               // Pixels scrolled each frame
+	SCROLL_GAP  = "    "          // Between the end of scrolling text and its start coming round again
+)
+
+// scroller is a line of text that scrolls round if it is too wide for the display
+type scroller struct {
+	line  *canvas
+	width int // Of the display
+
+	pos  int
+	hold time.Time // When to start scrolling from the start of the line
+}
+
+func newScroller(font *displayFont, text string, width int) *scroller {
+	s := &scroller{width: width}
+	s.setText(font, text)
+	return s
+}
+
+// setText changes the text, carrying on scrolling from the same point if it still scrolls
+func (s *scroller) setText(font *displayFont, text string) {
+	if textWidth(font, text) > s.width {
+		text += SCROLL_GAP
+	}
+
+	w := textWidth(font, text)
+	if w < s.width {
+		w = s.width
+	}
+
+	s.line = newCanvas(w, font.Height)
+	s.line.Text(0, 0, font, text)
+	if !s.scrolls() || s.pos >= w {
+		s.pos, s.hold = 0, time.Time{}
+	}
+}
+
+// scrolls returns whether the text is too wide to fit
+func (s *scroller) scrolls() bool {
+	return s.line.Width > s.width
+}
+
+// draw draws what the line shows now at y
+func (s *scroller) draw(c *canvas, y int) {
+	// The end of the line wraps round to the start
+	first := s.line.Width - s.pos
+	if first > s.width {
+		first = s.width
+	}
+	c.Blit(s.line, s.pos, 0, 0, y, first, s.line.Height)
+	c.Blit(s.line, 0, 0, first, y, s.width-first, s.line.Height)
+}
+
+// step moves the line along if it scrolls, after it has been shown
+func (s *scroller) step() {
+	if !s.scrolls() {
+		return
+	}
+
+	// Hold at the start, then scroll all the way round back to it
+	if s.pos == 0 {
+		if s.hold.IsZero() {
+			s.hold = time.Now().Add(SCROLL_HOLD)
+		}
+		if time.Now().Before(s.hold) {
+			return
+		}
+		s.hold = time.Time{}
+	}
+
+	s.pos += SCROLL_STEP
+	if s.pos >= s.line.Width {
+		s.pos = 0
+	}
+}
+
+// displayText returns frames of text centred vertically, scrolling if needed, until the context is cancelled.
+// Text sent on updates replaces it without scrolling from the start again.
+func displayText(width, height int, font *displayFont, text string, updates chan string, ctx context.Context) chan *canvas {
+	out := make(chan *canvas)
+	s := newScroller(font, text, width)
+
+	go func() {
+		var c *canvas
+		for {
+			if c == nil {
+				c = newCanvas(width, height)
+				s.draw(c, (height-font.Height)/2)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case text := <-updates:
+				s.setText(font, text)
+				c = nil
+			case out <- c:
+				// Text that fits is the same every frame
+				if s.scrolls() {
+					s.step()
+					c = nil
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// displayLines returns frames of two lines, one in each half of the display, that scroll on their own.
+// Lines sent on updates replace them without scrolling from the start again.
+func displayLines(width, height int, font *displayFont, top, bottom string, updates chan [2]string, ctx context.Context) chan *canvas {
+	out := make(chan *canvas)
+	lines := []*scroller{newScroller(font, top, width), newScroller(font, bottom, width)}
+
+	go func() {
+		var c *canvas
+		for {
+			if c == nil {
+				c = newCanvas(width, height)
+				for k, v := range lines {
+					// Fonts taller than half the display are cut off rather than overlapping
+					c.SetClip(image.Rect(0, k*height/2, width, (k+1)*height/2))
+					v.draw(c, k*height/2)
+				}
+				c.ResetClip()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case text := <-updates:
+				for k, v := range lines {
+					v.setText(font, text[k])
+				}
+				c = nil
+			case out <- c:
+				for _, v := range lines {
+					v.step()
+				}
+				c = nil
+			}
+		}
+	}()
+
+	return out
+}
+
+// displayClock returns frames of the time, centred on the display, until the context is cancelled
+func displayClock(width, height int, font *displayFont, ctx context.Context) chan *canvas {
+	out := make(chan *canvas)
+
+	go func() {
+		for {
+			h, m, sec := time.Now().Local().Clock()
+			clock := fmt.Sprintf("%02d:%02d:%02d", h, m, sec)
+
+			c := newCanvas(width, height)
+			c.Text((width-textWidth(font, clock))/2, (height-font.Height)/2, font, clock)
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- c:
+			}
+		}
+	}()
+
+	return out
+}
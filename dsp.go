@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const MAX_EQ_BANDS = 10
+
+// DSPSettings is the tone control for a player
+type DSPSettings struct {
+	EQ      []EQBand `json:"eq"`
+	Bass    float64  `json:"bass"`    // dB, -12 to 12
+	Treble  float64  `json:"treble"`  // dB, -12 to 12
+	Balance int      `json:"balance"` // -100 (left only) to 100 (right only)
+	Mono    bool     `json:"mono"`
+}
+
+// EQBand is a single band of the parametric equaliser
+type EQBand struct {
+	Frequency float64 `json:"frequency"` // Hz
+	Gain      float64 `json:"gain"`      // dB
+	Q         float64 `json:"q"`
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+// Clamp returns the settings with all values inside the supported ranges
+func (d DSPSettings) Clamp() DSPSettings {
+	d.Bass = clamp(d.Bass, -12, 12)
+	d.Treble = clamp(d.Treble, -12, 12)
+	d.Balance = int(clamp(float64(d.Balance), -100, 100))
+
+	if len(d.EQ) > MAX_EQ_BANDS {
+		d.EQ = d.EQ[:MAX_EQ_BANDS]
+	}
+
+	eq := make([]EQBand, len(d.EQ))
+	for k, v := range d.EQ {
+		if v.Q == 0 {
+			v.Q = 1
+		}
+
+		eq[k] = EQBand{
+			Frequency: clamp(v.Frequency, 20, 20000),
+			Gain:      clamp(v.Gain, -24, 24),
+			Q:         clamp(v.Q, 0.1, 10),
+		}
+	}
+	d.EQ = eq
+
+	return d
+}
+
+// ChannelGains returns the multipliers for the left and right channels from the balance
+func (d DSPSettings) ChannelGains() (left, right float64) {
+	left, right = 1, 1
+	if d.Balance > 0 {
+		left = 1 - float64(d.Balance)/100
+	} else if d.Balance < 0 {
+		right = 1 + float64(d.Balance)/100
+	}
+
+	return left, right
+}
+
+// Filters returns the ffmpeg audio filter chain for the settings.
+// Players that handle tone, balance and mono in hardware should set hardwareTone.
+func (d DSPSettings) Filters(hardwareTone bool) string {
+	var filters []string
+	for _, v := range d.EQ {
+		if v.Gain == 0 {
+			continue
+		}
+
+		filters = append(filters, fmt.Sprintf("equalizer=f=%g:t=q:w=%g:g=%g", v.Frequency, v.Q, v.Gain))
+	}
+
+	if !hardwareTone {
+		if d.Bass != 0 {
+			filters = append(filters, fmt.Sprintf("bass=g=%g", d.Bass))
+		}
+		if d.Treble != 0 {
+			filters = append(filters, fmt.Sprintf("treble=g=%g", d.Treble))
+		}
+		if d.Mono {
+			filters = append(filters, "pan=stereo|c0=0.5*c0+0.5*c1|c1=0.5*c0+0.5*c1")
+		}
+	}
+
+	return strings.Join(filters, ",")
+}
+
+// getDSP returns the saved dsp settings for a player
+func getDSP(id string) DSPSettings {
+	return getPersistentClient(id).DSP
+}
+
+// saveDSP persists the dsp settings for a player
+func saveDSP(id string, d DSPSettings) {
+	updatePersistentClient(id, func(c *PersistentClient) {
+		c.DSP = d
+	})
+}
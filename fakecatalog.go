@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// fakeCatalog serves a fixed set of songs from a json fixture, for trying things
+// out without a youtube music account. Everything but the songs refers to them by id.
+type fakeCatalog struct {
+	Songs     []Song `json:"songs"`
+	Playlists []struct {
+		ID        string   `json:"id"`
+		Title     string   `json:"title"`
+		Thumbnail string   `json:"thumbnail"`
+		Tracks    []string `json:"tracks"`
+	} `json:"playlists"`
+	Albums  map[string][]string `json:"albums"`
+	Artists map[string][]string `json:"artists"`
+	Radio   map[string][]string `json:"related"`
+	LRC     map[string]string   `json:"lyrics"`
+
+	byID map[string]Song
+}
+
+func newFakeCatalog(path string) (*fakeCatalog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeCatalog{}
+	err = json.Unmarshal(b, f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse catalog fixture: %w", err)
+	}
+
+	f.byID = make(map[string]Song)
+	for _, v := range f.Songs {
+		f.byID[v.ID] = v
+	}
+
+	return f, nil
+}
+
+// songs looks up a list of ids, leaving out any that aren't in the fixture
+func (f *fakeCatalog) songs(ids []string) []Song {
+	songs := []Song{}
+	for _, v := range ids {
+		if s, ok := f.byID[v]; ok {
+			songs = append(songs, s)
+		}
+	}
+
+	return songs
+}
+
+func (f *fakeCatalog) Browse() ([]Playlist, error) {
+	var playlists []Playlist
+	for _, v := range f.Playlists {
+		playlists = append(playlists, Playlist{ID: v.ID, Title: v.Title, Thumbnail: v.Thumbnail, TrackCount: len(v.Tracks)})
+	}
+
+	return playlists, nil
+}
+
+func (f *fakeCatalog) Playlist(id string, start int, count int) (Playlist, error) {
+	for _, v := range f.Playlists {
+		if v.ID == id {
+			songs := f.songs(v.Tracks)
+			return Playlist{ID: v.ID, Title: v.Title, Thumbnail: v.Thumbnail, TrackCount: len(songs), Tracks: pageOf(songs, start, count)}, nil
+		}
+	}
+
+	return Playlist{}, fmt.Errorf("unknown playlist %q", id)
+}
+
+func (f *fakeCatalog) Album(id string) ([]Song, error) {
+	ids, ok := f.Albums[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown album %q", id)
+	}
+
+	return f.songs(ids), nil
+}
+
+func (f *fakeCatalog) Artist(id string) ([]Song, error) {
+	ids, ok := f.Artists[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown artist %q", id)
+	}
+
+	return f.songs(ids), nil
+}
+
+func (f *fakeCatalog) Search(query string) ([]Song, error) {
+	return searchSongs(f.Songs, query), nil
+}
+
+func (f *fakeCatalog) Related(videoID string) ([]Song, error) {
+	return f.songs(f.Radio[videoID]), nil
+}
+
+func (f *fakeCatalog) Song(videoID string) (Song, error) {
+	song, ok := f.byID[videoID]
+	if !ok {
+		return song, fmt.Errorf("unknown song %q", videoID)
+	}
+
+	return song, nil
+}
+
+func (f *fakeCatalog) Lyrics(song Song) ([]lyricLine, error) {
+	lrc, ok := f.LRC[song.ID]
+	if !ok {
+		return nil, errNoLyrics
+	}
+
+	return parseLRC(lrc)
+}
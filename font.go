@@ -1,61 +1,220 @@
 package main
 
 import (
-	"encoding/binary"
-	"io"
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
 )
 
-type psfFont struct {
-	Version       uint32
-	HeaderSize    uint32
-	Flags         uint32
-	NumGlyphs     uint32
-	BytesPerGlyph uint32
-	Height        uint32
-	Width         uint32
-	GlyphBuffer   []byte
+// Drawn when there is no glyph or transliteration for a character
+const FALLBACK_GLYPH = '?'
+
+// The widest or tallest glyph read from a font, in pixels. Anything bigger is a broken font
+const MAX_GLYPH_SIZE = 256
+
+// Characters that don't decompose into an ascii letter and an accent
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L",
+	'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "Th", 'ı': "i",
+	'‘': "'", '’': "'", '‚': ",", '“': "\"", '”': "\"", '„': "\"", '–': "-", '—': "-", '…': "...", '•': "*",
+	'\u00a0': " ",
+}
+
+// displayFont is a font drawn in fixed size cells on a player's display. Glyphs wider
+// than a cell, like CJK characters, take up more than one.
+type displayFont struct {
+	Name   string
+	Width  int // Of a cell in pixels
+	Height int
+
+	// Each cell of a glyph is a row of Width bits at a time, padded to whole bytes
+	glyphs map[rune][][]byte
 }
 
-func readPSF(f *os.File) psfFont {
-	header := make([]byte, 32)
-	_, err := f.Read(header)
+// bitmap is a glyph before it is cut into cells
+type bitmap struct {
+	width  int
+	height int
+	px     []bool
+}
+
+func newBitmap(width, height int) bitmap {
+	return bitmap{width: width, height: height, px: make([]bool, width*height)}
+}
+
+func (b bitmap) set(x, y int) {
+	if x >= 0 && x < b.width && y >= 0 && y < b.height {
+		b.px[y*b.width+x] = true
+	}
+}
+
+// Fonts are shared between players with the same font and cell size
+var fontCache = make(map[string]*displayFont)
+var fontCacheMu sync.Mutex
+
+// loadFont reads a PSF1, PSF2 or BDF font to draw in cells of the given size. Glyphs
+// are centred vertically in the cell, and cropped if the font is too tall.
+func loadFont(path string, width, height int) (*displayFont, error) {
+	key := fmt.Sprintf("%v@%dx%d", path, width, height)
+
+	fontCacheMu.Lock()
+	defer fontCacheMu.Unlock()
+	if f, ok := fontCache[key]; ok {
+		return f, nil
+	}
+
+	b, err := os.ReadFile(path)
 	if err != nil {
-		logger.Panicw("unable to read font header",
-			"err", err)
+		return nil, err
+	}
+
+	var glyphs map[rune]bitmap
+	switch {
+	case bytes.HasPrefix(b, PSF2_MAGIC):
+		glyphs, err = parsePSF2(b)
+	case bytes.HasPrefix(b, PSF1_MAGIC):
+		glyphs, err = parsePSF1(b)
+	case bytes.HasPrefix(b, []byte("STARTFONT")):
+		glyphs, err = parseBDF(b)
+	default:
+		err = errors.New("unknown font format")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read font %v: %w", path, err)
+	}
+	if len(glyphs) == 0 {
+		return nil, fmt.Errorf("font %v has no glyphs", path)
+	}
+
+	f := &displayFont{Name: path, Width: width, Height: height, glyphs: make(map[rune][][]byte, len(glyphs))}
+	for r, g := range glyphs {
+		f.glyphs[r] = f.cut(g)
 	}
 
-	if header[0] != 0x72 || header[1] != 0xb5 || header[2] != 0x4a || header[3] != 0x86 {
-		logger.Panic("file is not a psf font")
+	fontCache[key] = f
+	return f, nil
+}
+
+// blankFont draws nothing, for when no font could be loaded
+func blankFont(width, height int) *displayFont {
+	return &displayFont{Name: "blank", Width: width, Height: height, glyphs: make(map[rune][][]byte)}
+}
+
+// cut splits a glyph into cells
+func (f *displayFont) cut(g bitmap) [][]byte {
+	n := (g.width + f.Width - 1) / f.Width
+	if n < 1 {
+		n = 1
 	}
 
-	p := psfFont{
-		Version:       binary.LittleEndian.Uint32(header[4:8]),
-		HeaderSize:    binary.LittleEndian.Uint32(header[8:12]),
-		Flags:         binary.LittleEndian.Uint32(header[12:16]),
-		NumGlyphs:     binary.LittleEndian.Uint32(header[16:20]),
-		BytesPerGlyph: binary.LittleEndian.Uint32(header[20:24]),
-		Height:        binary.LittleEndian.Uint32(header[24:28]),
-		Width:         binary.LittleEndian.Uint32(header[28:32]),
+	rowBytes := (f.Width + 7) / 8
+	top := (f.Height - g.height) / 2
+
+	cells := make([][]byte, n)
+	for c := range cells {
+		cell := make([]byte, rowBytes*f.Height)
+		for y := 0; y < f.Height; y++ {
+			gy := y - top
+			if gy < 0 || gy >= g.height {
+				continue
+			}
+
+			for x := 0; x < f.Width; x++ {
+				gx := c*f.Width + x
+				if gx < g.width && g.px[gy*g.width+gx] {
+					cell[y*rowBytes+x/8] |= 0x80 >> (x % 8)
+				}
+			}
+		}
+		cells[c] = cell
 	}
 
-	f.Seek(32, 0)
-	b, _ := io.ReadAll(f)
-	p.GlyphBuffer = b
+	return cells
+}
+
+// cells returns the cells to draw the text with, transliterating characters the font has no glyph for
+func (f *displayFont) cells(text string) [][]byte {
+	var cells [][]byte
+	for _, v := range text {
+		if g, ok := f.glyphs[v]; ok {
+			cells = append(cells, g...)
+			continue
+		}
 
-	return p
+		for _, t := range f.transliterate(v) {
+			if g, ok := f.glyphs[t]; ok {
+				cells = append(cells, g...)
+			} else {
+				cells = append(cells, make([]byte, (f.Width+7)/8*f.Height))
+			}
+		}
+	}
+
+	return cells
 }
 
-func (p psfFont) getChar(chr int) []byte {
-	if chr > 127 {
-		// Ignore all unicode
-		chr = 'a'
+// transliterate returns something close to a character that the font can draw, like e for é
+func (f *displayFont) transliterate(r rune) string {
+	if t, ok := transliterations[r]; ok && f.canDraw(t) {
+		return t
 	}
 
-	char := make([]byte, p.BytesPerGlyph)
-	for k := range char {
-		char[k] = p.GlyphBuffer[chr*int(p.BytesPerGlyph)+k]
+	// Drop the accents from the character
+	var base []rune
+	for _, v := range norm.NFD.String(string(r)) {
+		if !unicode.Is(unicode.Mn, v) {
+			base = append(base, v)
+		}
+	}
+	if len(base) > 0 && f.canDraw(string(base)) {
+		return string(base)
+	}
+
+	return string(FALLBACK_GLYPH)
+}
+
+// canDraw returns whether the font has a glyph for every character
+func (f *displayFont) canDraw(text string) bool {
+	for _, v := range text {
+		if _, ok := f.glyphs[v]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// playerFont loads a font for a player's display: the player's own, then the one for the
+// display size, then the default. Missing or broken fonts are logged and skipped.
+func playerFont(playerID string, own string, display string, width, height int, defaultFont string) *displayFont {
+	persistentMu.Lock()
+	paths := []string{own, persistent.Fonts[display], defaultFont}
+	persistentMu.Unlock()
+
+	for _, v := range paths {
+		if v == "" {
+			continue
+		}
+
+		f, err := loadFont(v, width, height)
+		if err != nil {
+			logger.Errorw("unable to load font",
+				"player", playerID,
+				"display", display,
+				"err", err)
+			continue
+		}
+
+		return f
 	}
 
-	return char
+	logger.Errorw("no font for display, leaving it blank",
+		"player", playerID,
+		"display", display)
+	return blankFont(width, height)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// glyphRows draws a glyph as rows of # and ., to compare in tests
+func glyphRows(b bitmap) string {
+	var rows []string
+	for y := 0; y < b.height; y++ {
+		row := ""
+		for x := 0; x < b.width; x++ {
+			if b.px[y*b.width+x] {
+				row += "#"
+			} else {
+				row += "."
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return strings.Join(rows, "/")
+}
+
+// testPSF1 builds a PSF1 font 2 pixels high, where glyph n has its nth pixel on in the top row
+func testPSF1(mode byte, numGlyphs int, table ...uint16) []byte {
+	b := append([]byte{}, PSF1_MAGIC...)
+	b = append(b, mode, 2)
+	for k := 0; k < numGlyphs; k++ {
+		b = append(b, 0x80>>(k%8), 0)
+	}
+	for _, v := range table {
+		b = append(b, byte(v), byte(v>>8))
+	}
+
+	return b
+}
+
+// testPSF2 builds a PSF2 font from its header fields, where glyph n has its nth pixel on in the top row
+func testPSF2(flags, numGlyphs, bytesPerGlyph, height, width uint32, table string) []byte {
+	b := append([]byte{}, PSF2_MAGIC...)
+	for _, v := range []uint32{0, 32, flags, numGlyphs, bytesPerGlyph, height, width} {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], v)
+	}
+	for k := 0; k < int(numGlyphs) && k < 4; k++ {
+		glyph := make([]byte, bytesPerGlyph)
+		glyph[0] = 0x80 >> k
+		b = append(b, glyph...)
+	}
+
+	return append(b, table...)
+}
+
+func TestParsePSF(t *testing.T) {
+	for _, v := range []struct {
+		name  string
+		parse func([]byte) (map[rune]bitmap, error)
+		font  []byte
+		want  map[rune]string // Glyphs expected, or nil if the font is broken
+	}{
+		{"psf1 truncated header", parsePSF1, PSF1_MAGIC, nil},
+		{"psf1 missing glyphs", parsePSF1, testPSF1(0, 255), nil},
+		{"psf1 512 missing glyphs", parsePSF1, testPSF1(PSF1_MODE_512, 256), nil},
+		{"psf1 ascii", parsePSF1, testPSF1(0, 256), map[rune]string{
+			'A': ".#....../........",
+			127: ".......#/........",
+			128: "",
+		}},
+		{"psf1 table", parsePSF1, testPSF1(PSF1_MODE_HAS_TABLE, 256, 'A', 0xe9, PSF1_SEPARATOR, PSF1_START_SEQ, 'e', 0x301, PSF1_SEPARATOR, 'A', PSF1_SEPARATOR), map[rune]string{
+			'A':  "#......./........",
+			0xe9: "#......./........",
+			'e':  "",
+		}},
+		{"psf2 truncated header", parsePSF2, PSF2_MAGIC, nil},
+		{"psf2 zero width", parsePSF2, testPSF2(0, 2, 3, 3, 0, ""), nil},
+		{"psf2 negative width", parsePSF2, testPSF2(0, 2, 3, 3, 0xffffffff, ""), nil},
+		{"psf2 oversized height", parsePSF2, testPSF2(0, 1, 1000, MAX_GLYPH_SIZE+1, 5, ""), nil},
+		{"psf2 wrong glyph size", parsePSF2, testPSF2(0, 2, 4, 3, 5, ""), nil},
+		{"psf2 missing glyphs", parsePSF2, testPSF2(0, 5, 3, 3, 5, ""), nil},
+		{"psf2 overflowing glyph count", parsePSF2, testPSF2(0, 0xffffffff, 3, 3, 5, ""), nil},
+		{"psf2 ascii", parsePSF2, testPSF2(0, 3, 3, 3, 5, ""), map[rune]string{
+			0: "#..../...../.....",
+			1: ".#.../...../.....",
+			2: "..#../...../.....",
+		}},
+		{"psf2 table", parsePSF2, testPSF2(PSF2_HAS_UNICODE_TABLE, 3, 3, 3, 5, "\xffЖ\xfeé\xff\xff"), map[rune]string{
+			'Ж': ".#.../...../.....",
+			'é': "",
+		}},
+	} {
+		glyphs, err := v.parse(v.font)
+		if v.want == nil {
+			if err == nil {
+				t.Errorf("%v: parsed a broken font", v.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", v.name, err)
+			continue
+		}
+
+		// Code points expected to be missing are listed with no rows
+		for r, want := range v.want {
+			if got := glyphRows(glyphs[r]); got != want {
+				t.Errorf("%v: %q is %v, want %v", v.name, r, got, want)
+			}
+		}
+	}
+}
+
+// testBDF builds a BDF font with a 4x4 bounding box whose baseline is a pixel above the bottom
+func testBDF(fontBox string, chars ...string) []byte {
+	return []byte(fmt.Sprintf("STARTFONT 2.1\nFONTBOUNDINGBOX %v\nCHARS %d\n%vENDFONT\n", fontBox, len(chars), strings.Join(chars, "")))
+}
+
+func testBDFChar(encoding, dwidth, bbx string, rows ...string) string {
+	return fmt.Sprintf("STARTCHAR c\nENCODING %v\nDWIDTH %v 0\nBBX %v\nBITMAP\n%v\nENDCHAR\n", encoding, dwidth, bbx, strings.Join(rows, "\n"))
+}
+
+func TestParseBDF(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		font []byte
+		want map[rune]string // Glyphs expected, or nil if the font is broken
+	}{
+		{"glyph on baseline", testBDF("4 4 0 -1", testBDFChar("65", "4", "2 2 1 0", "C0", "40")), map[rune]string{
+			'A': "..../.##./..#./....",
+		}},
+		{"descender", testBDF("4 4 0 -1", testBDFChar("103", "4", "1 2 0 -1", "80", "80")), map[rune]string{
+			'g': "..../..../#.../#...",
+		}},
+		{"double width", testBDF("4 4 0 -1", testBDFChar("12354", "8", "8 1 0 0", "81")), map[rune]string{
+			'あ': "......../......../#......#/........",
+		}},
+		{"default advance", testBDF("4 4 0 -1", testBDFChar("66", "0", "1 1 3 2", "80")), map[rune]string{
+			'B': "...#/..../..../....",
+		}},
+		{"unencoded glyph skipped", testBDF("4 4 0 -1", testBDFChar("-1", "4", "1 1 0 0", "80"), testBDFChar("67", "4", "1 1 0 0", "80")), map[rune]string{
+			'C': "..../..../#.../....",
+		}},
+		{"no bounding box", []byte("STARTFONT 2.1\n" + testBDFChar("65", "4", "1 1 0 0", "80")), nil},
+		{"empty font bounding box", testBDF("0 4 0 -1"), nil},
+		{"oversized font bounding box", testBDF(fmt.Sprintf("%d 4 0 -1", MAX_GLYPH_SIZE+1)), nil},
+		{"negative glyph width", testBDF("4 4 0 -1", testBDFChar("65", "4", "-1 1 0 0", "80")), nil},
+		{"oversized glyph offset", testBDF("4 4 0 -1", testBDFChar("65", "4", fmt.Sprintf("1 1 %d 0", -MAX_GLYPH_SIZE-1), "80")), nil},
+		{"negative advance", testBDF("4 4 0 -1", testBDFChar("65", "-4", "1 1 0 0", "80")), nil},
+		{"oversized advance", testBDF("4 4 0 -1", testBDFChar("65", fmt.Sprint(MAX_GLYPH_SIZE+1), "1 1 0 0", "80")), nil},
+		{"missing rows", testBDF("4 4 0 -1", testBDFChar("65", "4", "1 2 0 0", "80")), nil},
+		{"bad hex", testBDF("4 4 0 -1", testBDFChar("65", "4", "1 1 0 0", "zz")), nil},
+	} {
+		glyphs, err := parseBDF(v.font)
+		if v.want == nil {
+			if err == nil {
+				t.Errorf("%v: parsed a broken font", v.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", v.name, err)
+			continue
+		}
+
+		if len(glyphs) != len(v.want) {
+			t.Errorf("%v: parsed %v glyphs, want %v", v.name, len(glyphs), len(v.want))
+		}
+		for r, want := range v.want {
+			if got := glyphRows(glyphs[r]); got != want {
+				t.Errorf("%v: %q is %v, want %v", v.name, r, got, want)
+			}
+		}
+	}
+}
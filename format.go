@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// audioFormat is the pcm format sent to a player
+type audioFormat struct {
+	SampleRate int `json:"sampleRate"`
+	BitDepth   int `json:"bitDepth"`
+	Channels   int `json:"channels"`
+}
+
+// The format used when a player has not been configured otherwise
+var defaultFormat = audioFormat{SampleRate: 44100, BitDepth: 16, Channels: 2}
+
+// Sample rates and sizes as encoded in the strm command
+var strmSampleRates = map[int]byte{
+	8000: '5', 11025: '0', 12000: '6', 16000: '7', 22050: '1', 24000: '8',
+	32000: '2', 44100: '3', 48000: '4', 96000: '9',
+}
+
+var strmSampleSizes = map[int]byte{8: '0', 16: '1', 24: '2', 32: '3'}
+
+// BytesPerSecond returns the data rate of the format
+func (f audioFormat) BytesPerSecond() int {
+	return f.SampleRate * f.BitDepth / 8 * f.Channels
+}
+
+// strmParams returns the sample size, sample rate and channel bytes for the strm command
+func (f audioFormat) strmParams() (size, rate, channels byte) {
+	return strmSampleSizes[f.BitDepth], strmSampleRates[f.SampleRate], byte('0' + f.Channels)
+}
+
+// codec returns the ffmpeg codec that outputs the format
+func (f audioFormat) codec() string {
+	if f.BitDepth == 8 {
+		return "pcm_u8"
+	}
+
+	return fmt.Sprintf("pcm_s%vle", f.BitDepth)
+}
+
+// capabilities returns the best format supported by a device, from its device id
+// and the capabilities string sent in its HELO
+func capabilities(deviceID byte, helo []byte) audioFormat {
+	caps := audioFormat{SampleRate: 44100, BitDepth: 16, Channels: 2}
+	switch deviceID {
+	case 4:
+		// Squeezebox 2/3
+		caps.SampleRate, caps.BitDepth = 48000, 24
+	case 5:
+		// Transporter
+		caps.SampleRate, caps.BitDepth = 96000, 24
+	case 12:
+		// Squeezeplay/squeezelite
+		caps.BitDepth = 24
+	}
+
+	// Newer firmware lists its capabilities after the fixed fields
+	if len(helo) > 44 {
+		for _, v := range strings.Split(strings.TrimRight(string(helo[44:]), "\x00"), ",") {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) != 2 || kv[0] != "MaxSampleRate" {
+				continue
+			}
+
+			if rate, err := strconv.Atoi(kv[1]); err == nil {
+				caps.SampleRate = rate
+			}
+		}
+	}
+
+	return caps
+}
+
+// negotiateFormat chooses the closest format to that configured which the player supports.
+// Zero values in the configured format fall back to the default.
+func negotiateFormat(caps, config audioFormat) audioFormat {
+	f := defaultFormat
+	if config.SampleRate != 0 {
+		f.SampleRate = config.SampleRate
+	}
+	if config.BitDepth != 0 {
+		f.BitDepth = config.BitDepth
+	}
+
+	// Pick the highest supported rate that is not above what was asked for
+	rate := 8000
+	for r := range strmSampleRates {
+		if r <= f.SampleRate && r <= caps.SampleRate && r > rate {
+			rate = r
+		}
+	}
+	f.SampleRate = rate
+
+	if _, ok := strmSampleSizes[f.BitDepth]; !ok || f.BitDepth > caps.BitDepth {
+		f.BitDepth = caps.BitDepth
+	}
+
+	return f
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	sb2 := audioFormat{SampleRate: 48000, BitDepth: 24, Channels: 2}
+	sb1 := audioFormat{SampleRate: 44100, BitDepth: 16, Channels: 2}
+
+	for _, v := range []struct {
+		name   string
+		caps   audioFormat
+		config audioFormat
+		want   audioFormat
+	}{
+		{"unconfigured", sb2, audioFormat{}, defaultFormat},
+		{"supported", sb2, audioFormat{SampleRate: 48000, BitDepth: 24}, audioFormat{SampleRate: 48000, BitDepth: 24, Channels: 2}},
+		{"rate only", sb2, audioFormat{SampleRate: 32000}, audioFormat{SampleRate: 32000, BitDepth: 16, Channels: 2}},
+		{"depth only", sb2, audioFormat{BitDepth: 24}, audioFormat{SampleRate: 44100, BitDepth: 24, Channels: 2}},
+		{"rate above device", sb1, audioFormat{SampleRate: 96000}, audioFormat{SampleRate: 44100, BitDepth: 16, Channels: 2}},
+		{"depth above device", sb1, audioFormat{BitDepth: 24}, audioFormat{SampleRate: 44100, BitDepth: 16, Channels: 2}},
+		{"rate between supported", sb2, audioFormat{SampleRate: 40000}, audioFormat{SampleRate: 32000, BitDepth: 16, Channels: 2}},
+		{"rate below supported", sb2, audioFormat{SampleRate: 4000}, audioFormat{SampleRate: 8000, BitDepth: 16, Channels: 2}},
+		{"unknown depth", sb2, audioFormat{BitDepth: 20}, audioFormat{SampleRate: 44100, BitDepth: 24, Channels: 2}},
+		{"transporter", audioFormat{SampleRate: 96000, BitDepth: 24, Channels: 2}, audioFormat{SampleRate: 192000, BitDepth: 32}, audioFormat{SampleRate: 96000, BitDepth: 24, Channels: 2}},
+	} {
+		got := negotiateFormat(v.caps, v.config)
+		if got != v.want {
+			t.Errorf("%v: negotiated %+v, want %+v", v.name, got, v.want)
+		}
+
+		// Whatever is chosen has to be expressible in a strm command
+		size, rate, _ := got.strmParams()
+		if size == 0 || rate == 0 {
+			t.Errorf("%v: %+v can't be sent to the player", v.name, got)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	helo := func(caps string) []byte {
+		return append(make([]byte, 44), caps...)
+	}
+
+	for _, v := range []struct {
+		name     string
+		deviceID byte
+		helo     []byte
+		want     audioFormat
+	}{
+		{"squeezebox 1", 2, make([]byte, 36), audioFormat{SampleRate: 44100, BitDepth: 16, Channels: 2}},
+		{"squeezebox 2", 4, make([]byte, 36), audioFormat{SampleRate: 48000, BitDepth: 24, Channels: 2}},
+		{"transporter", 5, make([]byte, 36), audioFormat{SampleRate: 96000, BitDepth: 24, Channels: 2}},
+		{"squeezelite", 12, helo("Model=squeezelite,MaxSampleRate=192000,flc,pcm\x00"), audioFormat{SampleRate: 192000, BitDepth: 24, Channels: 2}},
+		{"bad max rate", 12, helo("MaxSampleRate=fast"), audioFormat{SampleRate: 44100, BitDepth: 24, Channels: 2}},
+		{"no max rate", 4, helo("Model=baby"), audioFormat{SampleRate: 48000, BitDepth: 24, Channels: 2}},
+	} {
+		if got := capabilities(v.deviceID, v.helo); got != v.want {
+			t.Errorf("%v: capable of %+v, want %+v", v.name, got, v.want)
+		}
+	}
+}
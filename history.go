@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// History is appended to as json lines, so a crash loses at most the entry being written
+const HISTORY_LOCATION = "slimytm_history.jsonl"
+
+const (
+	DEFAULT_HISTORY_LIMIT = 50
+	MAX_HISTORY_LIMIT     = 500
+	HISTORY_MEMORY_LIMIT  = 10000 // Plays kept in memory to query, older ones are only on disk
+	HISTORY_WRITE_BUFFER  = 100   // Plays waiting to be written before they are dropped
+)
+
+// Why a track stopped playing
+const (
+	ENDED_COMPLETED = "completed"
+	ENDED_SKIPPED   = "skipped"
+	ENDED_WATCHDOG  = "watchdog"
+	ENDED_ERROR     = "error"
+	ENDED_STOPPED   = "stopped" // The queue was reset or the player went away
+)
+
+// HistoryEntry is a single play of a track on a player
+type HistoryEntry struct {
+	Player       string    `json:"player"`
+	PlayerName   string    `json:"playerName"`
+	Song         Song      `json:"song"`
+	Start        time.Time `json:"start"`
+	ListenedSecs int       `json:"listenedSecs"`
+	EndReason    string    `json:"endReason"`
+
+	listened  time.Duration
+	scrobbled bool
+}
+
+var history []HistoryEntry
+var historyMu sync.Mutex
+
+// Plays waiting for the writer, and how many are yet to be written
+var historyWrites = make(chan HistoryEntry, HISTORY_WRITE_BUFFER)
+var historyPending sync.WaitGroup
+
+// Whether plays are no longer written because slimytm is stopping. Protected by historyClosedMu,
+// which is held while adding to historyPending so nothing is added once it is being waited on
+var historyClosed bool
+var historyClosedMu sync.Mutex
+
+// loadHistory reads the history recorded by previous runs
+func loadHistory() {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	f, err := os.Open(HISTORY_LOCATION)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.Errorw("unable to open history",
+			"location", HISTORY_LOCATION,
+			"err", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var e HistoryEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			logger.Warnw("skipping unreadable history entry",
+				"err", err)
+			continue
+		}
+
+		history = append(history, e)
+		trimHistory()
+	}
+}
+
+// trimHistory drops the oldest plays kept in memory past the limit. Must be called with historyMu held
+func trimHistory() {
+	if len(history) > HISTORY_MEMORY_LIMIT {
+		history = history[len(history)-HISTORY_MEMORY_LIMIT:]
+	}
+}
+
+// addHistory records a finished play in memory, and queues it to be written to disk
+func addHistory(e HistoryEntry) {
+	historyMu.Lock()
+	history = append(history, e)
+	trimHistory()
+	historyMu.Unlock()
+
+	historyClosedMu.Lock()
+	if historyClosed {
+		historyClosedMu.Unlock()
+		logger.Warnw("history is closed, not saving play",
+			"video", e.Song.ID)
+		return
+	}
+	historyPending.Add(1)
+	historyClosedMu.Unlock()
+
+	select {
+	case historyWrites <- e:
+	default:
+		historyPending.Done()
+		logger.Errorw("history writer is behind, not saving play",
+			"video", e.Song.ID)
+	}
+}
+
+// historyWriter appends plays to the history file as they finish
+func historyWriter() {
+	for e := range historyWrites {
+		writeHistory(e)
+		historyPending.Done()
+	}
+}
+
+// flushHistory records the plays in progress on every queue, then stops recording
+// plays and waits for the queued ones to be written
+func flushHistory() {
+	for _, v := range allQueues() {
+		q := v
+		q.do(func(st *QueueState) {
+			q.endTrack(st, ENDED_STOPPED)
+		})
+	}
+
+	historyClosedMu.Lock()
+	historyClosed = true
+	historyClosedMu.Unlock()
+
+	historyPending.Wait()
+}
+
+// writeHistory appends a play to the history file
+func writeHistory(e HistoryEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorw("unable to encode history entry",
+			"err", err)
+		return
+	}
+
+	f, err := os.OpenFile(HISTORY_LOCATION, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Errorw("unable to open history",
+			"location", HISTORY_LOCATION,
+			"err", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		logger.Errorw("unable to write history",
+			"location", HISTORY_LOCATION,
+			"err", err)
+	}
+}
+
+// beginTrack starts recording a play of the current song, unless one is already being recorded
+func (q *Queue) beginTrack(st *QueueState) {
+	song, ok := st.CurrentSong()
+	if !ok || q.track != nil {
+		return
+	}
+
+	q.track = &HistoryEntry{
+		Player:     q.Player.GetID(),
+		PlayerName: q.Player.GetName(),
+		Song:       song,
+		Start:      time.Now(),
+	}
+	scrobbleNowPlaying(q.track.Player, song)
+	publishEvent(q.Player, EVENT_TRACK_STARTED, song, nil)
+}
+
+// listenedTo adds to how long the current play has been listened to, scrobbling it once it has been long enough
+func (q *Queue) listenedTo(d time.Duration) {
+	if q.track == nil {
+		return
+	}
+
+	q.track.listened += d
+	if !q.track.scrobbled && q.track.listened >= scrobbleAfter(q.track.Song) {
+		q.track.scrobbled = true
+		scrobble(q.track.Player, q.track.Song, q.track.Start)
+	}
+}
+
+// endTrack finishes recording the current play, if there is one
+func (q *Queue) endTrack(st *QueueState, reason string) {
+	if q.track == nil {
+		return
+	}
+
+	e := *q.track
+	q.track = nil
+
+	e.ListenedSecs = int(e.listened.Seconds())
+	e.EndReason = reason
+	logger.Debugw("track ended",
+		"video", e.Song.ID,
+		"listened", e.ListenedSecs,
+		"reason", reason)
+
+	addHistory(e)
+	publishEvent(q.Player, EVENT_TRACK_ENDED, e.Song, map[string]interface{}{
+		"reason":       reason,
+		"listenedSecs": e.ListenedSecs,
+	})
+}
+
+// historyFilter selects entries from the history. Empty fields match everything
+type historyFilter struct {
+	Player  string // id or name
+	VideoID string
+	Reason  string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f historyFilter) matches(e HistoryEntry) bool {
+	return (f.Player == "" || e.Player == f.Player || e.PlayerName == f.Player) &&
+		(f.VideoID == "" || e.Song.ID == f.VideoID) &&
+		(f.Reason == "" || e.EndReason == f.Reason) &&
+		(f.Since.IsZero() || !e.Start.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Start.Before(f.Until))
+}
+
+// queryHistory returns a page of the matching entries, newest first, and how many match in total
+func queryHistory(f historyFilter, offset, limit int) ([]HistoryEntry, int) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	var matches []HistoryEntry
+	for i := len(history) - 1; i >= 0; i-- {
+		if f.matches(history[i]) {
+			matches = append(matches, history[i])
+		}
+	}
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	return append([]HistoryEntry{}, matches[offset:end]...), total
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestFlushHistoryRecordsPlaying(t *testing.T) {
+	testEnv(t)
+	t.Cleanup(func() {
+		historyClosedMu.Lock()
+		historyClosed = false
+		historyClosedMu.Unlock()
+	})
+
+	// Collect what would be written, until the test is over. Plays queued by earlier tests are left out
+	var mu sync.Mutex
+	var written []HistoryEntry
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case e := <-historyWrites:
+				mu.Lock()
+				if e.Player == "history" || e.Song.ID == "late" {
+					written = append(written, e)
+				}
+				mu.Unlock()
+				historyPending.Done()
+			}
+		}
+	}()
+
+	q, _ := newTestQueue(t, "history")
+	addQueue(q)
+	t.Cleanup(func() { removeQueue(q) })
+	q.Replace(testSongs("s", 2), 0)
+	waitFor(t, "the song to play", func() bool { return q.State().Playing })
+
+	// The song playing when slimytm stops is written, and nothing after it
+	flushHistory()
+	addHistory(HistoryEntry{Song: Song{ID: "late"}})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 1 || written[0].Song.ID != "s0" || written[0].EndReason != ENDED_STOPPED {
+		t.Fatalf("wrote %+v", written)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Events published on the bus
+const (
+	EVENT_TRACK_STARTED       = "track_started"
+	EVENT_TRACK_ENDED         = "track_ended"
+	EVENT_PAUSED              = "paused"
+	EVENT_UNPAUSED            = "unpaused"
+	EVENT_VOLUME_CHANGED      = "volume_changed"
+	EVENT_PLAYER_CONNECTED    = "player_connected"
+	EVENT_PLAYER_DISCONNECTED = "player_disconnected"
+	EVENT_IR_PRESSED          = "ir_pressed"
+)
+
+const (
+	HOOK_BUFFER       = 100 // Events waiting for a hook before new ones are dropped
+	HOOK_TIMEOUT      = time.Second * 10
+	HOOK_RETRIES      = 3
+	HOOK_RETRY_DELAY  = time.Second * 2 // Doubles after each failed attempt
+	HOOK_OUTPUT_LIMIT = 512             // How much of a failed hook's output is logged
+)
+
+// BusEvent is something that happened to a player. Hooks get it as the JSON body,
+// or as the data for their argument templates.
+type BusEvent struct {
+	Type       string                 `json:"type"`
+	Player     string                 `json:"player"`
+	PlayerName string                 `json:"playerName"`
+	Time       time.Time              `json:"time"`
+	Song       Song                   `json:"song"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// HookConfig is a command or webhook run for events, set in the persistent data
+type HookConfig struct {
+	Name    string   `json:"name"`
+	Events  []string `json:"events"`  // Every event if empty
+	Players []string `json:"players"` // Ids or names, every player if empty
+
+	Exec []string `json:"exec"` // A command and its arguments, each a text/template of the event
+	URL  string   `json:"url"`  // Where the event is POSTed as JSON
+
+	TimeoutSecs int `json:"timeoutSecs"`
+	Retries     int `json:"retries"`
+}
+
+// eventBus passes events to its subscribers without waiting for them
+type eventBus struct {
+	mu   sync.Mutex
+	subs []subscriber
+}
+
+type subscriber struct {
+	name   string
+	wants  func(BusEvent) bool // Which events are sent, so others don't take up room
+	events chan BusEvent
+}
+
+var bus eventBus
+
+var metricHookDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "slimytm_hook_events_dropped_total",
+	Help: "The number of events dropped because a hook was too far behind",
+}, []string{"hook"})
+
+var metricHookFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "slimytm_hook_failures_total",
+	Help: "The number of events a hook failed to handle after every retry",
+}, []string{"hook"})
+
+// subscribe returns a channel of the events published from now on that the subscriber wants
+func (b *eventBus) subscribe(name string, wants func(BusEvent) bool) chan BusEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan BusEvent, HOOK_BUFFER)
+	b.subs = append(b.subs, subscriber{name: name, wants: wants, events: c})
+	return c
+}
+
+// publish sends an event to every subscriber that wants it and has room for it. It never
+// blocks, so it is safe to call from the queue's event loop.
+func (b *eventBus) publish(e BusEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, v := range b.subs {
+		if !v.wants(e) {
+			continue
+		}
+
+		select {
+		case v.events <- e:
+		default:
+			logger.Warnw("subscriber too slow, dropping event",
+				"subscriber", v.name,
+				"event", e.Type,
+				"player", e.PlayerName)
+			metricHookDropped.WithLabelValues(v.name).Inc()
+		}
+	}
+}
+
+// publishEvent publishes an event about a player
+func publishEvent(p player, eventType string, song Song, data map[string]interface{}) {
+	bus.publish(BusEvent{
+		Type:       eventType,
+		Player:     p.GetID(),
+		PlayerName: p.GetName(),
+		Time:       time.Now(),
+		Song:       song,
+		Data:       data,
+	})
+}
+
+// startHooks subscribes each configured hook to the bus
+func startHooks(hooks []HookConfig) {
+	for k, v := range hooks {
+		if v.Name == "" {
+			v.Name = fmt.Sprintf("hook %d", k)
+		}
+		if (len(v.Exec) == 0) == (v.URL == "") {
+			logger.Errorw("hook needs either a command or a url",
+				"hook", v.Name)
+			continue
+		}
+
+		var args []*template.Template
+		valid := true
+		for _, a := range v.Exec {
+			t, err := template.New(v.Name).Parse(a)
+			if err != nil {
+				logger.Errorw("unable to parse hook argument",
+					"hook", v.Name,
+					"arg", a,
+					"err", err)
+				valid = false
+				break
+			}
+			args = append(args, t)
+		}
+		if !valid {
+			continue
+		}
+
+		go runHook(v, args, bus.subscribe(v.Name, v.matches))
+	}
+}
+
+// matches returns whether the hook wants an event
+func (h HookConfig) matches(e BusEvent) bool {
+	return emptyOrContains(h.Events, e.Type) && (emptyOrContains(h.Players, e.Player) || emptyOrContains(h.Players, e.PlayerName))
+}
+
+// emptyOrContains returns whether s is in the list, treating an empty list as containing everything
+func emptyOrContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return len(list) == 0
+}
+
+// runHook handles a hook's events one at a time, so they arrive in order
+func runHook(h HookConfig, args []*template.Template, events chan BusEvent) {
+	timeout := HOOK_TIMEOUT
+	if h.TimeoutSecs > 0 {
+		timeout = time.Duration(h.TimeoutSecs) * time.Second
+	}
+	retries := HOOK_RETRIES
+	if h.Retries > 0 {
+		retries = h.Retries
+	}
+
+	for e := range events {
+		delay := HOOK_RETRY_DELAY
+		for attempt := 0; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := h.deliver(ctx, args, e)
+			cancel()
+			if err == nil {
+				break
+			}
+
+			if attempt >= retries {
+				logger.Errorw("hook failed",
+					"hook", h.Name,
+					"event", e.Type,
+					"attempts", attempt+1,
+					"err", err)
+				metricHookFailures.WithLabelValues(h.Name).Inc()
+				break
+			}
+
+			logger.Infow("hook failed, retrying",
+				"hook", h.Name,
+				"event", e.Type,
+				"err", err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// deliver runs the hook's command or calls its webhook once
+func (h HookConfig) deliver(ctx context.Context, args []*template.Template, e BusEvent) error {
+	if len(args) == 0 {
+		return h.post(ctx, e)
+	}
+
+	var cmd []string
+	for _, t := range args {
+		var b strings.Builder
+		err := t.Execute(&b, e)
+		if err != nil {
+			return err
+		}
+		cmd = append(cmd, b.String())
+	}
+
+	out, err := exec.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
+	if err != nil {
+		if len(out) > HOOK_OUTPUT_LIMIT {
+			out = out[:HOOK_OUTPUT_LIMIT]
+		}
+		return fmt.Errorf("%w: %s", err, out)
+	}
+
+	return nil
+}
+
+// post sends the event to the hook's webhook
+func (h HookConfig) post(ctx context.Context, e BusEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// How the current song is laid out on the display
+const (
+	LAYOUT_SINGLE   = "single"  // One line of "title from album by artist"
+	LAYOUT_TWO_LINE = "twoLine" // The title on top, with the artist and album below
+)
+
+// lineDisplay is implemented by players tall enough to show two lines of text
+type lineDisplay interface {
+	// Display two lines, each scrolling on its own if needed. Lines sent on updates replace them,
+	// carrying on scrolling from the same point. Outputs framebuffers to the channel
+	DisplayLines(top, bottom string, updates chan [2]string, ctx context.Context) chan *canvas
+}
+
+// layouts returns the layouts the player can show
+func (q *Queue) layouts() []string {
+	if _, ok := q.Player.(lineDisplay); ok {
+		return []string{LAYOUT_SINGLE, LAYOUT_TWO_LINE}
+	}
+
+	return []string{LAYOUT_SINGLE}
+}
+
+// supportsLayout returns whether the player can show the layout
+func (q *Queue) supportsLayout(layout string) bool {
+	for _, v := range q.layouts() {
+		if v == layout {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetLayout changes how the song is shown on the display, and saves the choice
+func (q *Queue) SetLayout(layout string) error {
+	if !q.supportsLayout(layout) {
+		return fmt.Errorf("%v can't show the %q layout", q.Player.GetModel(), layout)
+	}
+
+	q.do(func(st *QueueState) {
+		st.Layout = layout
+		updatePersistentClient(q.Player.GetID(), func(c *PersistentClient) {
+			c.Layout = layout
+		})
+		q.updateClients(st)
+	})
+
+	return nil
+}
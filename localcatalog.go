@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Ids of local songs are their path in the library with this prefix
+const LOCAL_PREFIX = "local:"
+
+// How many files are probed for their duration at once when scanning the library
+const LOCAL_SCAN_WORKERS = 8
+
+var localAudioExtensions = map[string]bool{
+	".mp3": true, ".flac": true, ".ogg": true, ".opus": true, ".m4a": true, ".wav": true, ".aac": true,
+}
+
+// Strips track numbers like "01 - ", "1. " or "01 " from file names
+var localTrackNumber = regexp.MustCompile(`^\d+\s*(?:[-.]\s*)?`)
+
+// localCatalog plays music from a directory laid out as <artist>/<album>/<track>.
+// Playlists are .m3u files, and liked.m3u is the liked songs.
+type localCatalog struct {
+	root      string
+	songs     []Song
+	byID      map[string]Song
+	paths     map[string]string // Song ids to files
+	playlists []Playlist
+}
+
+func newLocalCatalog(root string) (*localCatalog, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &localCatalog{root: root, byID: make(map[string]Song), paths: make(map[string]string)}
+
+	var files, m3us []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if localAudioExtensions[ext] {
+			files = append(files, path)
+		} else if ext == ".m3u" || ext == ".m3u8" {
+			m3us = append(m3us, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan music directory: %w", err)
+	}
+
+	sort.Strings(files)
+	l.songs = make([]Song, len(files))
+
+	// Probing for durations is slow, so do a few at once
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for i := 0; i < LOCAL_SCAN_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next {
+				l.songs[k] = l.song(files[k])
+			}
+		}()
+	}
+	for k := range files {
+		next <- k
+	}
+	close(next)
+	wg.Wait()
+
+	for k, v := range l.songs {
+		l.byID[v.ID] = v
+		l.paths[v.ID] = files[k]
+	}
+
+	for _, v := range m3us {
+		l.playlists = append(l.playlists, l.readM3U(v))
+	}
+
+	logger.Infow("scanned local music",
+		"root", root,
+		"songs", len(l.songs),
+		"playlists", len(l.playlists))
+
+	return l, nil
+}
+
+// song works out what it can about a file from its path and ffprobe
+func (l *localCatalog) song(path string) Song {
+	rel, _ := filepath.Rel(l.root, path)
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	name := strings.TrimSuffix(parts[len(parts)-1], filepath.Ext(path))
+	song := Song{
+		ID:         LOCAL_PREFIX + filepath.ToSlash(rel),
+		Title:      localTrackNumber.ReplaceAllString(name, ""),
+		Artists:    []Artist{{Name: "Unknown artist"}},
+		Thumbnails: []Thumbnail{},
+	}
+	if song.Title == "" {
+		song.Title = name
+	}
+	if len(parts) >= 2 {
+		song.Artists = []Artist{{Name: parts[0]}}
+	}
+	if len(parts) >= 3 {
+		song.Album = Album{Name: parts[1]}
+	}
+
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration:format_tags=date", "-of", "default=noprint_wrappers=1", path).Output()
+	if err != nil {
+		logger.Warnw("unable to find duration of local song",
+			"path", path,
+			"err", err)
+		return song
+	}
+
+	// Lines are duration=<secs> and TAG:date=<date>, where the date starts with the year
+	for _, v := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(v), "=")
+		if key == "duration" {
+			secs, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				song.Duration = fmt.Sprintf("%d:%02d", int(secs)/60, int(secs)%60)
+			}
+		} else if strings.EqualFold(key, "TAG:date") && len(value) >= 4 {
+			song.Year = value[:4]
+		}
+	}
+
+	return song
+}
+
+// readM3U reads a playlist of paths relative to the playlist, or absolute ones
+func (l *localCatalog) readM3U(path string) Playlist {
+	rel, _ := filepath.Rel(l.root, path)
+	p := Playlist{
+		ID:    filepath.ToSlash(rel),
+		Title: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+	}
+	if strings.EqualFold(filepath.Base(path), "liked.m3u") {
+		p.ID = LIKED_PLAYLIST
+		p.Title = "Liked songs"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Warnw("unable to read playlist",
+			"path", path,
+			"err", err)
+		return p
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+
+		rel, err := filepath.Rel(l.root, line)
+		if err != nil {
+			continue
+		}
+		if song, ok := l.byID[LOCAL_PREFIX+filepath.ToSlash(rel)]; ok {
+			p.Tracks = append(p.Tracks, song)
+		}
+	}
+	p.TrackCount = len(p.Tracks)
+
+	return p
+}
+
+// where returns the songs whose id has the prefix, in library order
+func (l *localCatalog) where(prefix string) []Song {
+	var songs []Song
+	for _, v := range l.songs {
+		if strings.HasPrefix(v.ID, prefix) {
+			songs = append(songs, v)
+		}
+	}
+
+	return songs
+}
+
+func (l *localCatalog) Browse() ([]Playlist, error) {
+	playlists := []Playlist{{ID: "all", Title: "All songs", TrackCount: len(l.songs)}}
+	for _, v := range l.playlists {
+		v.Tracks = nil
+		playlists = append(playlists, v)
+	}
+
+	return playlists, nil
+}
+
+func (l *localCatalog) Playlist(id string, start int, count int) (Playlist, error) {
+	if id == "all" {
+		return Playlist{ID: id, Title: "All songs", TrackCount: len(l.songs), Tracks: pageOf(l.songs, start, count)}, nil
+	}
+
+	for _, v := range l.playlists {
+		if v.ID == id {
+			v.Tracks = pageOf(v.Tracks, start, count)
+			return v, nil
+		}
+	}
+
+	return Playlist{}, fmt.Errorf("unknown playlist %q", id)
+}
+
+// Album ids are the <artist>/<album> directory
+func (l *localCatalog) Album(id string) ([]Song, error) {
+	songs := l.where(LOCAL_PREFIX + strings.Trim(id, "/") + "/")
+	if len(songs) == 0 {
+		return nil, fmt.Errorf("unknown album %q", id)
+	}
+
+	return songs, nil
+}
+
+// Artist ids are the artist directory. Every song by them is returned, as there is nothing to rank them by
+func (l *localCatalog) Artist(id string) ([]Song, error) {
+	songs := l.where(LOCAL_PREFIX + strings.Trim(id, "/") + "/")
+	if len(songs) == 0 {
+		return nil, fmt.Errorf("unknown artist %q", id)
+	}
+
+	return songs, nil
+}
+
+func (l *localCatalog) Search(query string) ([]Song, error) {
+	return searchSongs(l.songs, query), nil
+}
+
+// Related returns the rest of the album, then everything else by the artist
+func (l *localCatalog) Related(videoID string) ([]Song, error) {
+	rel := strings.TrimPrefix(videoID, LOCAL_PREFIX)
+	if _, ok := l.byID[videoID]; !ok || !strings.Contains(rel, "/") {
+		return nil, fmt.Errorf("unknown song %q", videoID)
+	}
+
+	album := LOCAL_PREFIX + rel[:strings.LastIndex(rel, "/")+1]
+	artist := LOCAL_PREFIX + rel[:strings.Index(rel, "/")+1]
+
+	var songs []Song
+	for _, v := range l.where(album) {
+		if v.ID > videoID {
+			songs = append(songs, v)
+		}
+	}
+	for _, v := range l.where(artist) {
+		if !strings.HasPrefix(v.ID, album) {
+			songs = append(songs, v)
+		}
+	}
+
+	return songs, nil
+}
+
+func (l *localCatalog) Song(videoID string) (Song, error) {
+	song, ok := l.byID[videoID]
+	if !ok {
+		return song, fmt.Errorf("unknown song %q", videoID)
+	}
+
+	return song, nil
+}
+
+func (l *localCatalog) LocalPath(videoID string) (string, bool) {
+	path, ok := l.paths[videoID]
+	return path, ok
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The directory searched for local .lrc files
+const LYRICS_DIR = "lyrics"
+
+var errNoLyrics = errors.New("no time-synced lyrics available")
+
+// lyricLine is a single line of time-synced lyrics
+type lyricLine struct {
+	Start float64 `json:"start"` // Seconds from the start of the song
+	Text  string  `json:"text"`
+}
+
+// lyricsProvider fetches the time-synced lyrics for a song
+type lyricsProvider interface {
+	Lyrics(song Song) ([]lyricLine, error)
+}
+
+// fetchLyrics returns the lyrics for a song from the first provider that has them.
+// Local files are tried first, then the catalog if it has lyrics.
+func fetchLyrics(song Song) ([]lyricLine, error) {
+	providers := []lyricsProvider{localLyrics{dir: LYRICS_DIR}}
+	if p, ok := catalog.(lyricsProvider); ok {
+		providers = append(providers, p)
+	}
+
+	for _, p := range providers {
+		lines, err := p.Lyrics(song)
+		if errors.Is(err, errNoLyrics) {
+			continue
+		} else if err != nil {
+			logger.Warnw("unable to fetch lyrics",
+				"provider", fmt.Sprintf("%T", p),
+				"video", song.ID,
+				"err", err)
+			continue
+		}
+
+		return lines, nil
+	}
+
+	return nil, errNoLyrics
+}
+
+// localLyrics reads .lrc files named either <videoId>.lrc or "<artist> - <title>.lrc"
+type localLyrics struct {
+	dir string
+}
+
+func (l localLyrics) Lyrics(song Song) ([]lyricLine, error) {
+	names := []string{song.ID + ".lrc"}
+	if len(song.Artists) > 0 {
+		names = append(names, fmt.Sprintf("%v - %v.lrc", song.Artists[0].Name, song.Title))
+	}
+
+	for _, v := range names {
+		b, err := os.ReadFile(filepath.Join(l.dir, filepath.Base(v)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return parseLRC(string(b))
+	}
+
+	return nil, errNoLyrics
+}
+
+var lrcTimestamp = regexp.MustCompile(`\[(\d+):(\d+(?:\.\d+)?)\]`)
+
+// parseLRC parses LRC formatted lyrics, ignoring any lines without timestamps
+func parseLRC(lrc string) ([]lyricLine, error) {
+	var lines []lyricLine
+	for _, v := range strings.Split(lrc, "\n") {
+		stamps := lrcTimestamp.FindAllStringSubmatch(v, -1)
+		text := strings.TrimSpace(lrcTimestamp.ReplaceAllString(v, ""))
+
+		// A line may have several timestamps if it is repeated
+		for _, s := range stamps {
+			mins, _ := strconv.Atoi(s[1])
+			secs, _ := strconv.ParseFloat(s[2], 64)
+			lines = append(lines, lyricLine{Start: float64(mins*60) + secs, Text: text})
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil, errNoLyrics
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Start < lines[j].Start })
+	return lines, nil
+}
+
+// CurrentLyric returns the index of the line being sung, or -1 if there isn't one
+func (s QueueState) CurrentLyric() int {
+	line := -1
+	for k, v := range s.Lyrics {
+		if float64(s.ElapsedSecs) >= v.Start {
+			line = k
+		}
+	}
+
+	return line
+}
+
+// SetLyrics turns the lyrics display on or off and saves the choice
+func (q *Queue) SetLyrics(show bool) {
+	q.do(func(st *QueueState) {
+		q.setLyrics(st, show)
+	})
+}
+
+// ToggleLyrics turns the lyrics display on or off and saves the choice
+func (q *Queue) ToggleLyrics() {
+	q.do(func(st *QueueState) {
+		q.setLyrics(st, !st.ShowLyrics)
+	})
+}
+
+func (q *Queue) setLyrics(st *QueueState, show bool) {
+	st.ShowLyrics = show
+	updatePersistentClient(q.Player.GetID(), func(c *PersistentClient) {
+		c.Lyrics = show
+	})
+	q.updateClients(st)
+}
+
+// loadLyrics fetches the lyrics for the current song in the background
+func (q *Queue) loadLyrics(st *QueueState, song Song) {
+	st.Lyrics = nil
+	go func() {
+		lines, err := fetchLyrics(song)
+		if err != nil {
+			logger.Debugw("no lyrics for song",
+				"video", song.ID)
+			return
+		}
+
+		q.do(func(st *QueueState) {
+			if cur, ok := st.CurrentSong(); ok && cur.ID == song.ID {
+				st.Lyrics = lines
+				q.updateClients(st)
+			}
+		})
+	}()
+}
+
+// LyricsBuf returns buffers with the current line of the lyrics, until the context is cancelled
+func (q *Queue) LyricsBuf(ctx context.Context) chan *canvas {
+	var curText string
+	var curBuf chan *canvas
+	cancel := func() {}
+	out := make(chan *canvas)
+
+	go func() {
+		// The text being shown stops along with this
+		defer func() { cancel() }()
+
+		for {
+			text := ""
+			st := q.State()
+			if line := st.CurrentLyric(); line >= 0 {
+				text = st.Lyrics[line].Text
+			}
+
+			if curBuf == nil || curText != text {
+				// Stop the old line from scrolling forever
+				cancel()
+
+				var lineCtx context.Context
+				lineCtx, cancel = context.WithCancel(ctx)
+				curBuf = q.Player.DisplayText(text, nil, lineCtx)
+				curText = text
+			}
+
+			var buf *canvas
+			select {
+			case <-ctx.Done():
+				return
+			case buf = <-curBuf:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- buf:
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseLRC(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		lrc  string
+		want string // Lines as start:text, or empty if there are no lyrics
+	}{
+		{"empty", "", ""},
+		{"no timestamps", "[ar:Artist]\n[ti:Title]\nJust words", ""},
+		{"single line", "[00:12.50]Hello", "[12.5:Hello]"},
+		{"minutes", "[01:02]One\n[10:00.25]Two", "[62:One 600.25:Two]"},
+		{"tags and spacing", "[ar:Artist]\r\n[00:01.00]  Padded  \r\n\r\n[00:02.00]", "[1:Padded 2:]"},
+		{"several timestamps", "[00:30.00][00:10.00]Chorus\n[00:20.00]Verse", "[10:Chorus 20:Verse 30:Chorus]"},
+		{"timestamps through the line", "[00:05.00]Call [00:06.00]response", "[5:Call response 6:Call response]"},
+		{"same start keeps order", "[00:01.00]First\n[00:01.00]Second", "[1:First 1:Second]"},
+	} {
+		lines, err := parseLRC(v.lrc)
+		if v.want == "" {
+			if !errors.Is(err, errNoLyrics) {
+				t.Errorf("%v: parsed %v, %v", v.name, lines, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", v.name, err)
+			continue
+		}
+
+		var got []string
+		for _, l := range lines {
+			got = append(got, fmt.Sprintf("%v:%v", l.Start, l.Text))
+		}
+		if fmt.Sprint(got) != v.want {
+			t.Errorf("%v: parsed %v, want %v", v.name, got, v.want)
+		}
+	}
+}
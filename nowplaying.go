@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+)
+
+// The templates used when a player hasn't set its own. Lines after the first go on
+// the bottom line of two line layouts, and are joined with spaces otherwise.
+var defaultTemplates = map[string]string{
+	LAYOUT_SINGLE:   "{{.Title}}{{if .Album}} from {{.Album}}{{end}}{{if .Artists}} by {{.Artists}}{{end}}",
+	LAYOUT_TWO_LINE: "{{.Title}}\n{{.Artists}}{{if and .Artists .Album}} - {{end}}{{.Album}}",
+}
+
+// The longest template accepted
+const MAX_TEMPLATE_LENGTH = 1000
+
+// nowPlaying is what display templates can show about the current song
+type nowPlaying struct {
+	Title    string // The chapter of long mixes
+	Song     string // The title of the song, even when there are chapters
+	Artist   string // The first artist
+	Artists  string // Every artist, separated by commas
+	Album    string
+	Year     string
+	Position int // In the queue, from 1
+	Total    int // Songs in the queue
+	Elapsed  string
+	Duration string
+	Volume   int
+	Paused   bool
+	Shuffle  bool
+	Repeat   string
+}
+
+// newNowPlaying describes the current song for display templates
+func (q *Queue) newNowPlaying(st QueueState, song Song) nowPlaying {
+	var artists []string
+	for _, v := range song.Artists {
+		if v.Name != "" {
+			artists = append(artists, v.Name)
+		}
+	}
+
+	n := nowPlaying{
+		Title:    song.Title,
+		Song:     song.Title,
+		Artists:  strings.Join(artists, ", "),
+		Album:    song.Album.Name,
+		Year:     song.Year,
+		Position: st.Index + 1,
+		Total:    st.TotalHint(),
+		Elapsed:  formatSecs(st.ElapsedSecs),
+		Duration: song.Duration,
+		Volume:   q.Player.GetVolume(),
+		Paused:   st.Paused,
+		Shuffle:  st.Shuffle,
+		Repeat:   string(st.Repeat),
+	}
+	if len(artists) > 0 {
+		n.Artist = artists[0]
+	}
+	if c := st.CurrentChapter(); c >= 0 {
+		n.Title = song.Chapters[c].Title
+	}
+
+	return n
+}
+
+// parseDisplayTemplate checks a template can be shown, by running it on an example song
+func parseDisplayTemplate(text string) (*template.Template, error) {
+	if len(text) > MAX_TEMPLATE_LENGTH {
+		return nil, errors.New("template is too long")
+	}
+
+	t, err := template.New("display").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.Execute(&strings.Builder{}, nowPlaying{Title: "Title", Artists: "Artist", Position: 1, Total: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// displayTemplate returns the template for a layout, the player's own if it has one
+func (s QueueState) displayTemplate(layout string) string {
+	if t, ok := s.Templates[layout]; ok && t != "" {
+		return t
+	}
+
+	return defaultTemplates[layout]
+}
+
+// SetTemplate sets the template for the now playing text in a layout, going back to
+// the default if it is empty, and saves it
+func (q *Queue) SetTemplate(layout string, text string) error {
+	if _, ok := defaultTemplates[layout]; !ok {
+		return errors.New("unknown layout")
+	}
+
+	if text != "" {
+		_, err := parseDisplayTemplate(text)
+		if err != nil {
+			return err
+		}
+	}
+
+	q.do(func(st *QueueState) {
+		templates := make(map[string]string)
+		for k, v := range st.Templates {
+			templates[k] = v
+		}
+		templates[layout] = text
+		if text == "" {
+			delete(templates, layout)
+		}
+		st.Templates = templates
+
+		updatePersistentClient(q.Player.GetID(), func(c *PersistentClient) {
+			c.Templates = templates
+		})
+		q.updateClients(st)
+	})
+
+	return nil
+}
+
+// restoreTemplates returns the saved templates that can still be shown, leaving out any that can't
+func restoreTemplates(player string, saved map[string]string) map[string]string {
+	templates := make(map[string]string)
+	for layout, text := range saved {
+		if _, ok := defaultTemplates[layout]; !ok || text == "" {
+			continue
+		}
+
+		_, err := parseDisplayTemplate(text)
+		if err != nil {
+			logger.Warnw("unable to restore display template",
+				"player", player,
+				"layout", layout,
+				"err", err)
+			continue
+		}
+		templates[layout] = text
+	}
+
+	return templates
+}
+
+// nowPlayingText runs the display template for the layout on the current song, using
+// the default if the player's template fails. Parsed templates are kept in the cache.
+func (q *Queue) nowPlayingText(st QueueState, song Song, layout string, cache map[string]*template.Template) string {
+	n := q.newNowPlaying(st, song)
+	for _, v := range []string{st.displayTemplate(layout), defaultTemplates[layout]} {
+		t, ok := cache[v]
+		if !ok {
+			var err error
+			t, err = parseDisplayTemplate(v)
+			if err != nil {
+				logger.Warnw("unable to parse display template",
+					"player", q.Player.GetName(),
+					"err", err)
+			}
+			cache[v] = t
+		}
+		if t == nil {
+			continue
+		}
+
+		var b strings.Builder
+		err := t.Execute(&b, n)
+		if err == nil {
+			return b.String()
+		}
+	}
+
+	return song.Title
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestNowPlayingText(t *testing.T) {
+	testEnv(t)
+	q, p := newTestQueue(t, "nowplaying")
+	p.SetVolume(40)
+
+	song := Song{
+		ID:       "song",
+		Title:    "Song",
+		Artists:  []Artist{{Name: "First"}, {Name: ""}, {Name: "Second"}},
+		Album:    Album{Name: "Album"},
+		Year:     "1999",
+		Duration: "4:05",
+	}
+	bare := Song{ID: "bare", Title: "Bare"}
+	mix := Song{ID: "mix", Title: "Mix", Duration: "1:00:00", Chapters: []Chapter{{Title: "Intro", Start: 0, End: 60}, {Title: "Second track", Start: 60, End: 3600}}}
+
+	for _, v := range []struct {
+		name     string
+		song     Song
+		st       QueueState
+		layout   string
+		template string
+		want     string
+	}{
+		{"default single", song, QueueState{}, LAYOUT_SINGLE, "", "Song from Album by First, Second"},
+		{"default single without album or artists", bare, QueueState{}, LAYOUT_SINGLE, "", "Bare"},
+		{"default two line", song, QueueState{}, LAYOUT_TWO_LINE, "", "Song\nFirst, Second - Album"},
+		{"default two line without album", Song{Title: "Song", Artists: song.Artists}, QueueState{}, LAYOUT_TWO_LINE, "", "Song\nFirst, Second"},
+		{"default two line without artists", Song{Title: "Song", Album: song.Album}, QueueState{}, LAYOUT_TWO_LINE, "", "Song\nAlbum"},
+		{"chapter as title", mix, QueueState{ElapsedSecs: 90}, LAYOUT_SINGLE, "{{.Title}} ({{.Song}})", "Second track (Mix)"},
+		{"queue position", song, QueueState{Index: 1}, LAYOUT_SINGLE, "{{.Position}}/{{.Total}} {{.Artist}}", "2/3 First"},
+		{"playback", song, QueueState{ElapsedSecs: 65, Paused: true, Shuffle: true, Repeat: REPEAT_ONE}, LAYOUT_SINGLE,
+			"{{.Elapsed}}/{{.Duration}} {{.Volume}}% {{if .Paused}}paused{{end}} {{if .Shuffle}}shuffled{{end}} {{.Repeat}} {{.Year}}",
+			"1:05/4:05 40% paused shuffled one 1999"},
+		{"own template per layout", song, QueueState{Templates: map[string]string{LAYOUT_TWO_LINE: "{{.Album}}"}}, LAYOUT_SINGLE, "", "Song from Album by First, Second"},
+		{"failing template falls back to the default", song, QueueState{Paused: true}, LAYOUT_SINGLE, "{{if .Paused}}{{index .Artists 100}}{{end}}", "Song from Album by First, Second"},
+		{"broken template falls back to the default", song, QueueState{}, LAYOUT_SINGLE, "{{.Title", "Song from Album by First, Second"},
+	} {
+		st := v.st
+		st.Songs = []Song{v.song, v.song, v.song}
+		if v.template != "" {
+			st.Templates = map[string]string{v.layout: v.template}
+		}
+
+		got := q.nowPlayingText(st, v.song, v.layout, make(map[string]*template.Template))
+		if got != v.want {
+			t.Errorf("%v: rendered %q, want %q", v.name, got, v.want)
+		}
+	}
+}
+
+func TestParseDisplayTemplate(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		text string
+		ok   bool
+	}{
+		{"plain text", "Now playing", true},
+		{"fields", "{{.Title}} - {{.Artist}} {{.Position}}/{{.Total}}", true},
+		{"default single", defaultTemplates[LAYOUT_SINGLE], true},
+		{"default two line", defaultTemplates[LAYOUT_TWO_LINE], true},
+		{"longest", strings.Repeat("x", MAX_TEMPLATE_LENGTH), true},
+		{"too long", strings.Repeat("x", MAX_TEMPLATE_LENGTH+1), false},
+		{"unclosed action", "{{.Title", false},
+		{"unknown field", "{{.Lyrics}}", false},
+		{"unknown function", "{{upper .Title}}", false},
+	} {
+		_, err := parseDisplayTemplate(v.text)
+		if (err == nil) != v.ok {
+			t.Errorf("%v: parsed with %v", v.name, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	PAGE_SIZE     = 100 // How many songs of a large playlist are loaded at a time
+	PAGE_PREFETCH = 20  // How many songs can be left in the queue before the next page is loaded
+
+	PAGE_RETRY_MIN = 5 * time.Second // How long to wait before loading a page again after it failed
+	PAGE_RETRY_MAX = 5 * time.Minute // The longest wait, which it doubles up to
+)
+
+// PageLoader is where the rest of a partly loaded playlist comes from
+type PageLoader struct {
+	QueueType string `json:"queueType"`
+	ID        string `json:"id"`
+	Next      int    `json:"next"`  // Where the next page starts
+	Total     int    `json:"total"` // How many songs there are altogether, or 0 if it isn't known
+
+	failures int       // Failed attempts at loading the next page in a row
+	retryAt  time.Time // When to try loading the next page again
+}
+
+// More returns whether there are pages left to load. Without a total, pages are
+// loaded until a short one arrives.
+func (p PageLoader) More() bool {
+	return p.QueueType != "" && (p.Total == 0 || p.Next < p.Total)
+}
+
+// fetch retrieves the next page, returning it and where the page after it comes from
+func (p PageLoader) fetch() ([]Song, PageLoader, error) {
+	songs, total, err := getPage(p.QueueType, p.ID, p.Next, PAGE_SIZE)
+	if err != nil {
+		return nil, p, err
+	}
+
+	p.Next += len(songs)
+	p.failures = 0
+	p.retryAt = time.Time{}
+	if total > 0 {
+		p.Total = total
+	}
+
+	// An empty page means the playlist is shorter than we were told, and a short
+	// one is the end of a playlist of unknown length
+	if len(songs) == 0 || (p.Total == 0 && len(songs) < PAGE_SIZE) {
+		p = PageLoader{}
+	}
+
+	return songs, p, nil
+}
+
+// failed records a failed attempt at loading the next page, backing off before the next one
+func (p PageLoader) failed() PageLoader {
+	p.failures++
+
+	delay := PAGE_RETRY_MIN
+	for i := 1; i < p.failures && delay < PAGE_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > PAGE_RETRY_MAX {
+		delay = PAGE_RETRY_MAX
+	}
+	p.retryAt = time.Now().Add(delay)
+
+	return p
+}
+
+// pagedQueueType returns whether songs for a queue type are loaded in pages
+func pagedQueueType(queueType string) bool {
+	return queueType == "playlist" || queueType == "liked"
+}
+
+// getPage retrieves count songs of a playlist or the liked songs from start, along with
+// the total number of songs. The total is 0 if it isn't known.
+func getPage(queueType string, id string, start int, count int) ([]Song, int, error) {
+	if queueType == "liked" {
+		id = LIKED_PLAYLIST
+	}
+
+	p, err := catalog.Playlist(id, start, count)
+	return p.Tracks, p.TrackCount, err
+}
+
+// firstPage retrieves the first page of a playlist or the liked songs, and where the rest comes from
+func firstPage(queueType string, id string) ([]Song, PageLoader, error) {
+	songs, pages, err := PageLoader{QueueType: queueType, ID: id}.fetch()
+	if err != nil {
+		return nil, PageLoader{}, err
+	}
+
+	return songs, pages, nil
+}
+
+// pagesUntil retrieves pages of a playlist or the liked songs until they include a video,
+// and where the rest comes from. Every page is loaded if the video isn't in the playlist.
+func pagesUntil(queueType string, id string, videoID string) ([]Song, PageLoader, error) {
+	songs, pages, err := firstPage(queueType, id)
+	for err == nil && pages.More() && !hasSong(songs, videoID) {
+		var page []Song
+		page, pages, err = pages.fetch()
+		songs = append(songs, page...)
+	}
+	if err != nil {
+		return nil, PageLoader{}, err
+	}
+
+	return songs, pages, nil
+}
+
+// EnqueuePaged adds the first page of a playlist to the end of the queue, with the rest loaded
+// as they are needed. Nothing is added if the queue is still loading pages of another playlist,
+// as only one can be loaded at a time.
+func (q *Queue) EnqueuePaged(songs []Song, pages PageLoader) (added bool) {
+	q.do(func(st *QueueState) {
+		if st.Pages.More() {
+			return
+		}
+
+		added = true
+		if len(songs) > 0 {
+			q.enqueue(st, songs, false)
+		}
+		st.Pages = pages
+	})
+
+	return added
+}
+
+// enqueueSongs retrieves the songs for an enqueue event and adds them to the queue. Playlists
+// added to the end are loaded a page at a time when the queue can, and in full otherwise.
+func enqueueSongs(q *Queue, e EnqueueEvent, next bool) error {
+	if !pagedQueueType(e.QueueType) {
+		songs, err := resolveSongs(e.QueueType, e.QueueID, e.Song)
+		if err != nil {
+			return err
+		}
+
+		q.Enqueue(songs, next)
+		return nil
+	}
+
+	songs, pages, err := firstPage(e.QueueType, e.QueueID)
+	if err != nil || (!next && q.EnqueuePaged(songs, pages)) {
+		return err
+	}
+
+	for err == nil && pages.More() {
+		var page []Song
+		page, pages, err = pages.fetch()
+		songs = append(songs, page...)
+	}
+	if err != nil {
+		return err
+	}
+
+	q.Enqueue(songs, next)
+	return nil
+}
+
+// hasSong returns whether a video is in the songs
+func hasSong(songs []Song, videoID string) bool {
+	for _, v := range songs {
+		if v.ID == videoID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TotalHint returns how many songs the queue will have once every page is loaded,
+// or how many are loaded so far if the total isn't known
+func (s QueueState) TotalHint() int {
+	if s.Pages.More() && s.Pages.Total > 0 {
+		return len(s.Songs) + s.Pages.Total - s.Pages.Next
+	}
+
+	return len(s.Songs)
+}
+
+// checkPages loads the next page in the background when playback gets near the end of what is loaded
+func (q *Queue) checkPages(st *QueueState) {
+	if !st.Pages.More() || q.loadingPage || len(st.Songs)-st.Index > PAGE_PREFETCH || time.Now().Before(st.Pages.retryAt) {
+		return
+	}
+
+	q.loadingPage = true
+	pages := st.Pages
+	go func() {
+		songs, next, err := pages.fetch()
+
+		q.do(func(st *QueueState) {
+			q.loadingPage = false
+			if st.Pages != pages {
+				// The queue has been replaced since
+				return
+			}
+
+			if err != nil {
+				st.Pages = pages.failed()
+				logger.Warnw("unable to load next page",
+					"type", pages.QueueType,
+					"id", pages.ID,
+					"start", pages.Next,
+					"retryAt", st.Pages.retryAt,
+					"err", err)
+				return
+			}
+
+			logger.Debugw("loaded next page",
+				"type", pages.QueueType,
+				"id", pages.ID,
+				"start", pages.Next,
+				"songs", len(songs))
+
+			st.Pages = next
+			q.appendPage(st, songs)
+		})
+	}()
+}
+
+// appendPage adds a page to the end of the queue. When shuffled, the songs are
+// mixed in with those that haven't been played yet.
+func (q *Queue) appendPage(st *QueueState, songs []Song) {
+	if len(songs) == 0 {
+		q.updateClients(st)
+		return
+	}
+
+	if !st.Shuffle || !st.active() {
+		q.enqueue(st, songs, false)
+		return
+	}
+
+	st.Original = append(st.Original[:len(st.Original):len(st.Original)], songs...)
+
+	updated := append([]Song(nil), st.Songs...)
+	for _, v := range songs {
+		pos := st.Index + 1 + rand.Intn(len(updated)-st.Index)
+		updated = append(updated[:pos], append([]Song{v}, updated[pos:]...)...)
+	}
+	st.Songs = updated
+	q.updateClients(st)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+)
+
+// The share of connected clients that have to vote to skip a song, unless the host sets one
+const DEFAULT_VOTE_SHARE = 0.5
+
+// PartyState is the party mode of a queue. In party mode, clients other than the host
+// can only suggest songs and vote to skip.
+type PartyState struct {
+	Enabled   bool
+	Token     string // The secret given to the host, empty if only the APIs and remote are in control
+	VoteShare float64
+	Votes     []string // The clients that have voted to skip the current song
+}
+
+// PartyEvent turns party mode on or off
+type PartyEvent struct {
+	Enabled   bool    `json:"enabled"`
+	VoteShare float64 `json:"voteShare"`
+}
+
+// newPartyToken returns a secret for the host of a party
+func newPartyToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+// isGuest returns whether a client holding the token is restricted by party mode
+func (p PartyState) isGuest(token string) bool {
+	return p.Enabled && (p.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.Token)) != 1)
+}
+
+// votesNeeded returns how many votes it takes to skip a song with the clients looking at the player now
+func (p PartyState) votesNeeded(playerID string) int {
+	n := int(math.Ceil(p.VoteShare * float64(attachedClients(playerID))))
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// SetParty turns party mode on or off. Whoever holds the token is the host, given full control
+func (q *Queue) SetParty(enabled bool, token string, voteShare float64) {
+	if voteShare <= 0 || voteShare > 1 {
+		voteShare = DEFAULT_VOTE_SHARE
+	}
+
+	q.do(func(st *QueueState) {
+		st.Party = PartyState{}
+		if enabled {
+			st.Party = PartyState{Enabled: true, Token: token, VoteShare: voteShare}
+		}
+
+		logger.Infow("party mode changed",
+			"player", q.Player.GetName(),
+			"enabled", enabled,
+			"host", token != "")
+		q.updateClients(st)
+	})
+}
+
+// VoteSkip records a client's vote to skip the current song, skipping it once enough clients have voted
+func (q *Queue) VoteSkip(clientID string) {
+	q.do(func(st *QueueState) {
+		if _, ok := st.CurrentSong(); !ok {
+			return
+		}
+
+		for _, v := range st.Party.Votes {
+			if v == clientID {
+				return
+			}
+		}
+
+		st.Party.Votes = append(st.Party.Votes[:len(st.Party.Votes):len(st.Party.Votes)], clientID)
+		if len(st.Party.Votes) >= st.Party.votesNeeded(q.Player.GetID()) {
+			logger.Debug("enough votes to skip song")
+			q.next(st)
+			return
+		}
+
+		q.updateClients(st)
+	})
+}
+
+// RemoveVote takes back a client's vote to skip the current song, when it goes away
+func (q *Queue) RemoveVote(clientID string) {
+	q.do(func(st *QueueState) {
+		votes := make([]string, 0, len(st.Party.Votes))
+		for _, v := range st.Party.Votes {
+			if v != clientID {
+				votes = append(votes, v)
+			}
+		}
+		st.Party.Votes = votes
+		q.updateClients(st)
+	})
+}
+
+// Suggest adds songs to the end of the queue, leaving out any that are already
+// playing or still to come
+func (q *Queue) Suggest(songs []Song) {
+	q.do(func(st *QueueState) {
+		upcoming := make(map[string]bool)
+		if st.Index >= 0 && st.Index < len(st.Songs) {
+			for _, v := range st.Songs[st.Index:] {
+				upcoming[v.ID] = true
+			}
+		}
+
+		var fresh []Song
+		for _, v := range songs {
+			if !upcoming[v.ID] {
+				upcoming[v.ID] = true
+				fresh = append(fresh, v)
+			}
+		}
+
+		if len(fresh) == 0 {
+			logger.Debug("suggested songs are already queued")
+			return
+		}
+
+		q.enqueue(st, fresh, false)
+	})
+}
+
+// partyJSON describes the party mode for a client, without giving away who the host is or who voted
+func (q *Queue) partyJSON(st QueueState, host bool) []byte {
+	b, _ := json.Marshal(struct {
+		Enabled   bool    `json:"enabled"`
+		Host      bool    `json:"host"` // Whether the client is in control
+		VoteShare float64 `json:"voteShare"`
+		Votes     int     `json:"votes"`
+		Needed    int     `json:"needed"`
+	}{st.Party.Enabled, host, st.Party.VoteShare, len(st.Party.Votes), st.Party.votesNeeded(q.Player.GetID())})
+
+	return b
+}
+
+// hostToken returns the token the client was given as host of a player's party
+func (c *Client) hostToken(playerID string) string {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return c.hostTokens[playerID]
+}
+
+// setHostTokens stores tokens the client was given as host, by player id
+func (c *Client) setHostTokens(tokens map[string]string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c.hostTokens == nil {
+		c.hostTokens = make(map[string]string)
+	}
+	for k, v := range tokens {
+		c.hostTokens[k] = v
+	}
+}
+
+// startParty turns party mode on or off for a client, making them the host. The token
+// is sent to them, so they can stay the host when they reconnect.
+func (c *Client) startParty(q *Queue, p PartyEvent) {
+	var token string
+	if p.Enabled {
+		token = newPartyToken()
+		c.setHostTokens(map[string]string{q.Player.GetID(): token})
+
+		msg, _ := json.Marshal(map[string]map[string]string{
+			"partyToken": {"player": q.Player.GetID(), "token": token},
+		})
+		sendToClient(c, msg)
+	}
+
+	q.SetParty(p.Enabled, token, p.VoteShare)
+}
+
+// guestEvent handles an event from a guest in party mode. Songs they play are
+// suggested instead, and skipping takes a vote. Songs are retrieved off the listener.
+func (c *Client) guestEvent(q *Queue, e Event) {
+	if e.Type == "NEXT" {
+		// Only the clients counted towards the votes needed get a vote
+		if !c.attachedTo(q.Player.GetID()) {
+			logger.Warnw("vote from client not looking at player",
+				"client", c.ID,
+				"player", q.Player.GetID())
+			return
+		}
+		q.VoteSkip(c.ID)
+	} else if e.Type == "ENQUEUE" || e.Type == "PLAY_NEXT" {
+		var p EnqueueEvent
+		err := json.Unmarshal(e.Data, &p)
+		if err != nil {
+			logger.Warnw("unable to unmarshal event",
+				"err", err)
+			return
+		}
+
+		c.load(func() {
+			songs, err := resolveSongs(p.QueueType, p.QueueID, p.Song)
+			if err != nil {
+				logger.Errorw("unable to retrieve suggested songs",
+					"type", p.QueueType,
+					"id", p.QueueID,
+					"err", err)
+				return
+			}
+
+			q.Suggest(songs)
+		})
+	} else if e.Type == "PLAY" {
+		// Only the song they chose is suggested, not the whole playlist
+		var p PlayEvent
+		err := json.Unmarshal(e.Data, &p)
+		if err != nil {
+			logger.Warnw("unable to unmarshal event",
+				"err", err)
+			return
+		}
+
+		c.load(func() {
+			songs, err := resolveSongs("song", p.QueueID, p.StartSong)
+			if err != nil {
+				logger.Errorw("unable to retrieve suggested song",
+					"err", err)
+				return
+			}
+
+			q.Suggest(songs)
+		})
+	} else {
+		logger.Infow("guest not allowed to send event in party mode",
+			"client", c.ID,
+			"event", e.Type)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// partyState is the party mode as sent to a client
+type partyState struct {
+	Enabled bool `json:"enabled"`
+	Host    bool `json:"host"`
+	Votes   int  `json:"votes"`
+}
+
+// lastParty returns the party mode in the last state sent to a client
+func lastParty(c *Client) partyState {
+	var party partyState
+	for {
+		select {
+		case msg := <-c.send:
+			var st struct {
+				Party *partyState `json:"party"`
+			}
+			json.Unmarshal(msg, &st)
+			if st.Party != nil {
+				party = *st.Party
+			}
+		default:
+			return party
+		}
+	}
+}
+
+func TestPartyHostNeedsToken(t *testing.T) {
+	testEnv(t)
+	q, _ := newTestQueue(t, "party")
+	addQueue(q)
+	t.Cleanup(func() { removeQueue(q) })
+	q.Replace(testSongs("s", 3), 0)
+
+	host := &Client{ID: "host", Identity: "host", player: "party", send: make(chan []byte, CLIENT_SEND_BUFFER)}
+	guest := &Client{ID: "guest", Identity: "guest", player: "party", send: make(chan []byte, CLIENT_SEND_BUFFER)}
+	for _, v := range []*Client{host, guest} {
+		c := v
+		addClient(c)
+		t.Cleanup(func() { removeClient(c) })
+	}
+
+	// Skipping takes both clients
+	host.startParty(q, PartyEvent{Enabled: true, VoteShare: 1})
+
+	// Only the client given the token is the host, and is told so
+	party := q.State().Party
+	if party.Token == "" || party.Token != host.hostToken("party") {
+		t.Fatal("host wasn't given the party token")
+	}
+	if party.isGuest(host.hostToken("party")) || !party.isGuest(guest.hostToken("party")) || !party.isGuest("host") {
+		t.Fatal("host and guest aren't told apart by the token")
+	}
+	if !lastParty(host).Host || lastParty(guest).Host {
+		t.Fatal("clients were sent the wrong host")
+	}
+
+	// Votes are sent as a count, without the ids of who voted
+	q.VoteSkip(guest.ID)
+	if party := lastParty(guest); party.Votes != 1 {
+		t.Fatalf("sent %v votes", party.Votes)
+	}
+}
+
+func TestPartyVotes(t *testing.T) {
+	testEnv(t)
+	q, _ := newTestQueue(t, "votes")
+	addQueue(q)
+	t.Cleanup(func() { removeQueue(q) })
+	q.Replace(testSongs("s", 3), 0)
+
+	// Only identified clients looking at the player count towards the votes needed
+	var voters []*Client
+	for _, v := range []Client{
+		{ID: "a", Identity: "a", player: "votes"},
+		{ID: "b", Identity: "b", player: "votes"},
+		{ID: "c", Identity: "c", player: "votes"},
+		{ID: "d", Identity: "d", player: "other"},
+		{ID: "e", player: "votes"},
+	} {
+		c := v
+		c.send = make(chan []byte, CLIENT_SEND_BUFFER)
+		addClient(&c)
+		t.Cleanup(func() { removeClient(&c) })
+		voters = append(voters, &c)
+	}
+	a, b := voters[0], voters[1]
+
+	q.SetParty(true, "token", 0.5)
+	if needed := q.State().Party.votesNeeded("votes"); needed != 2 {
+		t.Fatalf("needed %v votes", needed)
+	}
+
+	// Nor can clients that aren't counted vote
+	for _, v := range voters[3:] {
+		v.guestEvent(q, Event{Type: "NEXT"})
+	}
+	if votes := q.State().Party.Votes; len(votes) != 0 {
+		t.Fatalf("counted votes %v", votes)
+	}
+
+	// A client can't vote twice by claiming to be someone else
+	if a.identify(IdentifyEvent{ID: "b"}) || a.Identity != "a" {
+		t.Fatal("client changed its identity")
+	}
+	if !a.identify(IdentifyEvent{ID: "a", Name: "again"}) {
+		t.Fatal("client couldn't identify again as itself")
+	}
+	q.VoteSkip(a.ID)
+	q.VoteSkip(a.ID)
+	if votes := q.State().Party.Votes; len(votes) != 1 {
+		t.Fatalf("counted votes %v", votes)
+	}
+
+	// Votes are taken back when the client goes away
+	a.attach("")
+	if votes := q.State().Party.Votes; len(votes) != 0 {
+		t.Fatalf("kept votes %v", votes)
+	}
+
+	a.attach("votes")
+	q.VoteSkip(a.ID)
+	q.VoteSkip(b.ID)
+	if st := q.State(); st.Index != 1 || len(st.Party.Votes) != 0 {
+		t.Fatalf("on song %v with votes %v", st.Index, st.Party.Votes)
+	}
+}
@@ -3,19 +3,45 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"sync"
 )
 
 type PersistentData struct {
 	// Map of MACs to names
 	Clients      map[string]PersistentClient `json:"clients"`
 	LogLocations []string                    `json:"logLocations"`
+	Catalog      CatalogConfig               `json:"catalog"`
+
+	// Scrobbling credentials of users, which players can scrobble as
+	ScrobbleUsers map[string]ScrobbleConfig `json:"scrobbleUsers"`
+
+	Hooks []HookConfig `json:"hooks"`
+
+	// Display sizes, like 280x16 or 320x32, to the fonts used on them
+	Fonts map[string]string `json:"fonts"`
 }
 
 type PersistentClient struct {
-	Name string `json:"name"`
+	Name   string      `json:"name"`
+	DSP    DSPSettings `json:"dsp"`
+	Format audioFormat `json:"format"` // Preferred output format, limited by the player's capabilities
+	Lyrics bool        `json:"lyrics"` // Whether lyrics are shown on the display
+
+	AutoResume bool `json:"autoResume"` // Whether a restored queue starts playing straight away
+	Autoplay   bool `json:"autoplay"`   // Whether related songs are added when the queue runs out
+
+	Scrobble ScrobbleConfig `json:"scrobble"`
+
+	Font     string `json:"font"`     // A PSF or BDF font for the display, instead of the one for its size
+	LineFont string `json:"lineFont"` // The font for each line of the two line layout
+	Layout   string `json:"layout"`   // How the song is laid out on the display
+	Progress bool   `json:"progress"` // Whether the elapsed time and a progress bar are shown
+
+	Templates map[string]string `json:"templates"` // Now playing templates by layout
 }
 
 var persistent PersistentData
+var persistentMu sync.Mutex
 
 const PERSISTENT_LOCATION = "slimytm_persistent.json"
 
@@ -48,6 +74,13 @@ func LoadPersistent() {
 }
 
 func SavePersistent() {
+	persistentMu.Lock()
+	defer persistentMu.Unlock()
+	savePersistent()
+}
+
+// savePersistent writes the persistent data. Must be called with persistentMu held
+func savePersistent() {
 	f, err := os.Create(PERSISTENT_LOCATION)
 	if err != nil {
 		logger.DPanicw("unable to save persistent data",
@@ -65,3 +98,38 @@ func SavePersistent() {
 			"err", err)
 	}
 }
+
+// getPersistentClient returns the persistent data for a player
+func getPersistentClient(id string) PersistentClient {
+	persistentMu.Lock()
+	defer persistentMu.Unlock()
+	return persistent.Clients[id]
+}
+
+// allPersistentClients returns a copy of the persistent data for every player
+func allPersistentClients() map[string]PersistentClient {
+	persistentMu.Lock()
+	defer persistentMu.Unlock()
+
+	out := make(map[string]PersistentClient, len(persistent.Clients))
+	for k, v := range persistent.Clients {
+		out[k] = v
+	}
+
+	return out
+}
+
+// updatePersistentClient modifies the persistent data for a player and saves it
+func updatePersistentClient(id string, update func(c *PersistentClient)) {
+	persistentMu.Lock()
+	defer persistentMu.Unlock()
+
+	if persistent.Clients == nil {
+		persistent.Clients = make(map[string]PersistentClient)
+	}
+
+	c := persistent.Clients[id]
+	update(&c)
+	persistent.Clients[id] = c
+	savePersistent()
+}
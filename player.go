@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,18 +20,28 @@ type player interface {
 	Listener()
 	Heartbeat()
 
-	// Display the clock. Outputs framebuffers to the channel
-	DisplayClock() chan []byte
-	// Display the text, scrolling if needed. Outputs framebuffers to the channel
-	DisplayText(text string, ctx context.Context) chan []byte
-	Render(buf []byte)
+	// Display the clock until the context is cancelled. Outputs frames to the channel
+	DisplayClock(ctx context.Context) chan *canvas
+	// Display the text, scrolling if needed. Text sent on updates replaces it, carrying on
+	// scrolling from the same point. Outputs frames to the channel
+	DisplayText(text string, updates chan string, ctx context.Context) chan *canvas
+	Render(c *canvas)
 
-	Play(videoID string) (cancel func())
+	// Play the video, starting offset seconds in. Returns once the player has been told
+	// to start, and stops streaming when the context is cancelled
+	Play(ctx context.Context, videoID string, offset int) error
 	Stop()
 
+	// The negotiated pcm format of the audio stream
+	GetFormat() audioFormat
+
 	SetVolume(level int)
 	GetVolume() int
 
+	// Apply tone settings, returning whether the stream has to be transcoded again for them to be heard
+	SetDSP(d DSPSettings) (restart bool)
+	GetDSP() DSPSettings
+
 	Pause()
 	Unpause()
 }
@@ -43,6 +55,7 @@ const (
 
 // lastIR is global to prevent multiple players picking up the same signal
 var lastIR time.Time
+var lastIRMu sync.Mutex
 
 var metricConnectedPlayers = promauto.NewGauge(prometheus.GaugeOpts{
 	Name: "slimytm_connected_players",
@@ -84,7 +97,7 @@ func tcpListener() {
 		logger.Debug("received new tcp connection")
 
 		b := make([]byte, 1024)
-		_, err = conn.Read(b)
+		n, err := conn.Read(b)
 		if err != nil {
 			logger.Errorw("unable to read from connection",
 				"err", err)
@@ -99,33 +112,106 @@ func tcpListener() {
 		logger.Debug("squeezebox says HELO!")
 
 		var c player
-		queue := &Queue{
-			Buffer: new(audioBufferWrapper),
-		}
+		queue := newQueue()
 
+		caps := capabilities(b[8], b[:n])
 		if b[8] == 2 {
 			c = &squeezebox1{conn: conn, Queue: queue, mac: net.HardwareAddr(b[10:16])}
 		} else if b[8] == 4 {
-			c = &squeezebox2{conn: conn, Queue: queue, mac: net.HardwareAddr(b[10:16])}
+			c = &squeezebox2{conn: conn, Queue: queue, mac: net.HardwareAddr(b[10:16]), caps: caps}
 		} else {
 			logger.Warnw("non-squeebox device tried to connect. pretending it is a sbox2")
-			c = &squeezebox2{conn: conn, Queue: queue, mac: net.HardwareAddr(b[10:16])}
+			c = &squeezebox2{conn: conn, Queue: queue, mac: net.HardwareAddr(b[10:16]), caps: caps}
 			// continue
 		}
 
 		logger.Infow("connected to a new squeezebox",
 			"assignedModel", c.GetModel(),
 			"firmware", b[9],
-			"mac", net.HardwareAddr(b[10:16]).String())
+			"mac", net.HardwareAddr(b[10:16]).String(),
+			"format", c.GetFormat())
 
 		queue.Player = c
-		queues = append(queues, queue)
+		addQueue(queue)
 
+		go queue.Watch()
 		go c.Listener()
 		go c.Heartbeat()
-		go queue.Watch()
+
+		queue.RestoreSettings(getPersistentClient(c.GetID()))
 
 		metricConnectedPlayers.Inc()
+		publishEvent(c, EVENT_PLAYER_CONNECTED, Song{}, nil)
+	}
+}
+
+// handleIR acts on a code from the remote
+func handleIR(p player, q *Queue, irCode string) {
+	lastIRMu.Lock()
+	if time.Since(lastIR) < IR_INTERVAL {
+		// Prevent duplicate IR commands from ruining our day
+		lastIRMu.Unlock()
+		return
+	}
+	lastIR = time.Now()
+	lastIRMu.Unlock()
+
+	logger.Debugw("ir event",
+		"code", irCode)
+	sendXPL(xplMessage{
+		messageType: "xpl-trig",
+		target:      "*",
+		schema:      "remote.basic",
+		body: map[string]string{
+			"keys":   irCode,
+			"device": p.GetName(),
+			"zone":   "slimserver",
+			"power":  "on",
+		},
+	}, "slimdev-slimserv."+p.GetName())
+	publishEvent(p, EVENT_IR_PRESSED, Song{}, map[string]interface{}{"code": irCode})
+
+	if handleTransferMenu(q, irCode) {
+		return
+	}
+
+	if irCode == "7689807f" {
+		// Volume UP
+		volume := q.AdjustVolume(VOLUME_INCREMENT)
+		q.PushText(fmt.Sprintf("Volume = %v/100", volume), time.Second*2)
+	} else if irCode == "768900ff" {
+		// Volume DOWN
+		volume := q.AdjustVolume(-VOLUME_INCREMENT)
+		q.PushText(fmt.Sprintf("Volume = %v/100", volume), time.Second*2)
+	} else if irCode == "7689a05f" {
+		// NEXT Song
+		q.Next()
+	} else if irCode == "7689c03f" {
+		// PREVIOUS Song
+		q.Previous()
+	} else if irCode == "768920df" {
+		// PAUSE/UNPAUSE Song
+		q.Pause()
+	} else if irCode == "768940bf" {
+		// RESET Queue
+		q.Reset()
+	} else if irCode == "76897887" {
+		// NOW PLAYING toggles lyrics
+		q.ToggleLyrics()
+	} else if irCode == "7689d827" {
+		// SHUFFLE on/off
+		if q.ToggleShuffle() {
+			q.PushText("Shuffle on", time.Second*2)
+		} else {
+			q.PushText("Shuffle off", time.Second*2)
+		}
+	} else if irCode == "768938c7" {
+		// REPEAT cycles off/all/one
+		mode := q.CycleRepeat()
+		q.PushText(fmt.Sprintf("Repeat %v", mode), time.Second*2)
+	} else if irCode == "7689d02f" {
+		// RIGHT opens the transfer menu, as nothing else uses it
+		openTransferMenu(q)
 	}
 }
 
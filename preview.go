@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+)
+
+// The default and largest scale of display snapshots
+const (
+	PREVIEW_SCALE     = 4
+	PREVIEW_MAX_SCALE = 16
+)
+
+// Colours of display snapshots, like the Squeezebox's VFD
+var previewPalette = color.Palette{color.RGBA{0x10, 0x10, 0x10, 0xff}, color.RGBA{0x40, 0xe0, 0xff, 0xff}}
+
+// displayFrame is a frame of a player's display sent to the clients watching it.
+// Pixels are packed a row at a time from the top, with the leftmost in the most
+// significant bit, and each row starting on a new byte.
+type displayFrame struct {
+	Player string `json:"player"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Frame  []byte `json:"frame"` // Base64 in json
+}
+
+// encodeRows packs a canvas a row at a time, for clients
+func encodeRows(c *canvas) []byte {
+	rowBytes := (c.Width + 7) / 8
+	buf := make([]byte, rowBytes*c.Height)
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			if c.pix[y*c.Width+x] {
+				buf[y*rowBytes+x/8] |= 0x80 >> (x % 8)
+			}
+		}
+	}
+
+	return buf
+}
+
+// Image draws the canvas with each pixel scale pixels square
+func (c *canvas) Image(scale int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, c.Width*scale, c.Height*scale), previewPalette)
+	for y := 0; y < c.Height*scale; y++ {
+		for x := 0; x < c.Width*scale; x++ {
+			if c.pix[(y/scale)*c.Width+x/scale] {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	return img
+}
+
+// Frame returns what was last rendered on the display, or nil if nothing has been
+func (q *Queue) Frame() *canvas {
+	q.frameMu.Lock()
+	defer q.frameMu.Unlock()
+	return q.frame
+}
+
+// rendered keeps the frame just rendered, and sends it to the clients watching
+// the display if it has changed
+func (q *Queue) rendered(c *canvas) {
+	packed := encodeRows(c)
+
+	q.frameMu.Lock()
+	changed := q.frame == nil || !bytes.Equal(packed, q.framePacked)
+	q.frame, q.framePacked = c, packed
+	q.frameMu.Unlock()
+
+	if changed {
+		sendDisplay(q.Player.GetID(), c, packed)
+	}
+}
+
+// sendDisplay sends a frame to the clients watching a player's display
+func sendDisplay(playerID string, c *canvas, packed []byte) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	var msg []byte
+	for _, v := range clients {
+		if !v.displays[playerID] {
+			continue
+		}
+
+		// Only encode the message if anyone is watching
+		if msg == nil {
+			msg, _ = json.Marshal(map[string]displayFrame{
+				"display": {Player: playerID, Width: c.Width, Height: c.Height, Frame: packed},
+			})
+		}
+		v.SendFrame(playerID, msg)
+	}
+}
+
+// watchDisplay starts or stops sending a player's display to the client. The current
+// frame is sent straight away, so the client doesn't wait for it to change.
+func (c *Client) watchDisplay(q *Queue, on bool) {
+	var msg []byte
+	if frame := q.Frame(); on && frame != nil {
+		msg, _ = json.Marshal(map[string]displayFrame{
+			"display": {Player: q.Player.GetID(), Width: frame.Width, Height: frame.Height, Frame: encodeRows(frame)},
+		})
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c.displays == nil {
+		c.displays = make(map[string]bool)
+	}
+	c.displays[q.Player.GetID()] = on
+	if !on {
+		delete(c.displays, q.Player.GetID())
+		delete(c.frames, q.Player.GetID())
+	} else if msg != nil {
+		c.SendFrame(q.Player.GetID(), msg)
+	}
+}
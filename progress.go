@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// The digits of the elapsed and remaining times, 3 pixels wide and 5 tall.
+// Each row is the low 3 bits, leftmost pixel first.
+var progressDigits = map[rune][5]byte{
+	'0': {0b111, 0b101, 0b101, 0b101, 0b111},
+	'1': {0b010, 0b110, 0b010, 0b010, 0b111},
+	'2': {0b111, 0b001, 0b111, 0b100, 0b111},
+	'3': {0b111, 0b001, 0b011, 0b001, 0b111},
+	'4': {0b101, 0b101, 0b111, 0b001, 0b001},
+	'5': {0b111, 0b100, 0b111, 0b001, 0b111},
+	'6': {0b111, 0b100, 0b111, 0b101, 0b111},
+	'7': {0b111, 0b001, 0b010, 0b010, 0b010},
+	'8': {0b111, 0b101, 0b111, 0b101, 0b111},
+	'9': {0b111, 0b101, 0b111, 0b001, 0b111},
+	':': {0b000, 0b010, 0b000, 0b010, 0b000},
+	'-': {0b000, 0b000, 0b111, 0b000, 0b000},
+}
+
+// Columns taken up by each digit, including the gap after it
+const PROGRESS_DIGIT_WIDTH = 4
+
+// drawDigits draws the time digits with their top left at x, y, each pixel scale pixels square
+func drawDigits(c *canvas, s string, x, y, scale int) {
+	for k, v := range s {
+		rows := progressDigits[v]
+		for row, bits := range rows {
+			for col := 0; col < 3; col++ {
+				if bits&(0b100>>col) == 0 {
+					continue
+				}
+
+				px := x + (k*PROGRESS_DIGIT_WIDTH+col)*scale
+				py := y + row*scale
+				c.FillRect(image.Rect(px, py, px+scale, py+scale), true)
+			}
+		}
+	}
+}
+
+// formatSecs formats a time like 3:07
+func formatSecs(secs int) string {
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// drawProgress draws the elapsed and remaining time in a box on the right of a copy of
+// the canvas, and a bar along the bottom. Digits are doubled on 32 pixel displays.
+// Without a duration, only the elapsed time is shown.
+func drawProgress(c *canvas, elapsed, duration int) *canvas {
+	c = c.Clone()
+
+	scale := c.Height / 16
+	if scale < 1 {
+		scale = 1
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if duration > 0 && elapsed > duration {
+		elapsed = duration
+	}
+
+	times := []string{formatSecs(elapsed)}
+	if duration > 0 {
+		times = append(times, "-"+formatSecs(duration-elapsed))
+	}
+
+	// Clear a box wide enough for the longest time, with a column of space before it
+	chars := 0
+	for _, v := range times {
+		if len(v) > chars {
+			chars = len(v)
+		}
+	}
+	barHeight := scale
+	boxWidth := (chars*PROGRESS_DIGIT_WIDTH + 1) * scale
+	c.FillRect(image.Rect(c.Width-boxWidth, 0, c.Width, c.Height-barHeight), false)
+
+	// Right align the times, one above the other
+	for k, v := range times {
+		drawDigits(c, v, c.Width-len(v)*PROGRESS_DIGIT_WIDTH*scale, (1+k*7)*scale, scale)
+	}
+
+	if duration > 0 {
+		filled := c.Width * elapsed / duration
+		c.FillRect(image.Rect(0, c.Height-barHeight, filled, c.Height), true)
+		c.FillRect(image.Rect(filled, c.Height-barHeight, c.Width, c.Height), false)
+	}
+
+	return c
+}
+
+// SetProgress turns the progress overlay on the display on or off, and saves the choice
+func (q *Queue) SetProgress(on bool) {
+	q.do(func(st *QueueState) {
+		q.setProgress(st, on)
+	})
+}
+
+// ToggleProgress turns the progress overlay on or off and saves the choice, returning whether it is now on
+func (q *Queue) ToggleProgress() (on bool) {
+	q.do(func(st *QueueState) {
+		q.setProgress(st, !st.Progress)
+		on = st.Progress
+	})
+
+	return on
+}
+
+func (q *Queue) setProgress(st *QueueState, on bool) {
+	st.Progress = on
+	updatePersistentClient(q.Player.GetID(), func(c *PersistentClient) {
+		c.Progress = on
+	})
+	q.updateClients(st)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf8"
+)
+
+var (
+	PSF1_MAGIC = []byte{0x36, 0x04}
+	PSF2_MAGIC = []byte{0x72, 0xb5, 0x4a, 0x86}
+)
+
+const (
+	PSF1_MODE_512       = 0x01 // The font has 512 glyphs instead of 256
+	PSF1_MODE_HAS_TABLE = 0x02
+	PSF1_SEPARATOR      = 0xffff
+	PSF1_START_SEQ      = 0xfffe
+
+	PSF2_HAS_UNICODE_TABLE = 0x01
+	PSF2_SEPARATOR         = 0xff // Ends the entries of a glyph
+	PSF2_START_SEQ         = 0xfe // Starts a sequence of code points that form one glyph
+)
+
+// parsePSF1 reads a PSF1 font, which is always 8 pixels wide
+func parsePSF1(b []byte) (map[rune]bitmap, error) {
+	if len(b) < 4 {
+		return nil, errors.New("truncated psf1 header")
+	}
+
+	mode, height := b[2], int(b[3])
+	numGlyphs := 256
+	if mode&PSF1_MODE_512 != 0 {
+		numGlyphs = 512
+	}
+
+	size := numGlyphs * height
+	if len(b) < 4+size {
+		return nil, errors.New("psf1 font is missing glyphs")
+	}
+
+	codes := make([][]rune, numGlyphs)
+	if mode&PSF1_MODE_HAS_TABLE != 0 {
+		table := b[4+size:]
+		glyph, inSeq := 0, false
+		for len(table) >= 2 && glyph < numGlyphs {
+			v := binary.LittleEndian.Uint16(table)
+			table = table[2:]
+
+			if v == PSF1_SEPARATOR {
+				glyph++
+				inSeq = false
+			} else if v == PSF1_START_SEQ {
+				inSeq = true
+			} else if !inSeq {
+				codes[glyph] = append(codes[glyph], rune(v))
+			}
+		}
+	}
+
+	return psfGlyphs(b[4:4+size], numGlyphs, 8, height, codes), nil
+}
+
+// parsePSF2 reads a PSF2 font
+func parsePSF2(b []byte) (map[rune]bitmap, error) {
+	if len(b) < 32 {
+		return nil, errors.New("truncated psf2 header")
+	}
+
+	headerSize := int(binary.LittleEndian.Uint32(b[8:12]))
+	flags := binary.LittleEndian.Uint32(b[12:16])
+	numGlyphs := int(binary.LittleEndian.Uint32(b[16:20]))
+	bytesPerGlyph := int(binary.LittleEndian.Uint32(b[20:24]))
+	height := int(binary.LittleEndian.Uint32(b[24:28]))
+	width := int(binary.LittleEndian.Uint32(b[28:32]))
+
+	if width <= 0 || height <= 0 || width > MAX_GLYPH_SIZE || height > MAX_GLYPH_SIZE || bytesPerGlyph != (width+7)/8*height {
+		return nil, errors.New("invalid psf2 glyph size")
+	}
+
+	// Checked against the length of the file first, so the size can't overflow
+	if headerSize < 32 || headerSize > len(b) || numGlyphs <= 0 || numGlyphs > (len(b)-headerSize)/bytesPerGlyph {
+		return nil, errors.New("psf2 font is missing glyphs")
+	}
+	size := numGlyphs * bytesPerGlyph
+
+	codes := make([][]rune, numGlyphs)
+	if flags&PSF2_HAS_UNICODE_TABLE != 0 {
+		// Code points are utf-8. Sequences of them are skipped, as we only draw one glyph per rune
+		table := b[headerSize+size:]
+		glyph, inSeq := 0, false
+		for len(table) > 0 && glyph < numGlyphs {
+			switch table[0] {
+			case PSF2_SEPARATOR:
+				glyph++
+				inSeq = false
+				table = table[1:]
+				continue
+			case PSF2_START_SEQ:
+				inSeq = true
+				table = table[1:]
+				continue
+			}
+
+			r, n := utf8.DecodeRune(table)
+			table = table[n:]
+			if !inSeq && r != utf8.RuneError {
+				codes[glyph] = append(codes[glyph], r)
+			}
+		}
+	}
+
+	return psfGlyphs(b[headerSize:headerSize+size], numGlyphs, width, height, codes), nil
+}
+
+// psfGlyphs maps code points to the glyphs of a psf font. Without a unicode table,
+// glyphs below 128 are assumed to be ascii.
+func psfGlyphs(buf []byte, numGlyphs, width, height int, codes [][]rune) map[rune]bitmap {
+	hasTable := false
+	for _, v := range codes {
+		hasTable = hasTable || len(v) > 0
+	}
+	if !hasTable {
+		for k := 0; k < numGlyphs && k < 128; k++ {
+			codes[k] = []rune{rune(k)}
+		}
+	}
+
+	rowBytes := (width + 7) / 8
+	glyphs := make(map[rune]bitmap)
+	for k, v := range codes {
+		if len(v) == 0 {
+			continue
+		}
+
+		g := newBitmap(width, height)
+		glyph := buf[k*rowBytes*height:]
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if glyph[y*rowBytes+x/8]&(0x80>>(x%8)) != 0 {
+					g.set(x, y)
+				}
+			}
+		}
+
+		// The first glyph listed for a code point wins
+		for _, r := range v {
+			if _, ok := glyphs[r]; !ok {
+				glyphs[r] = g
+			}
+		}
+	}
+
+	return glyphs
+}
@@ -6,22 +6,45 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const WATCHDOG_INTERVAL = time.Second * 5
+const (
+	WATCHDOG_INTERVAL = time.Second * 5
+	WATCH_INTERVAL    = time.Millisecond * 100 // How often the queue checks the state of playback
+)
 
 type Song struct {
 	ID         string      `json:"videoId"`
 	Title      string      `json:"title"`
 	Artists    []Artist    `json:"artists"`
 	Album      Album       `json:"album"`
+	Year       string      `json:"year,omitempty"`
 	Duration   string      `json:"duration"`
 	Thumbnails []Thumbnail `json:"thumbnails"`
+	Chapters   []Chapter   `json:"chapters,omitempty"`
+}
+
+// DurationSecs parses the duration of the song (h:mm:ss or m:ss) into seconds.
+// Returns 0 if the duration is unknown.
+func (s Song) DurationSecs() int {
+	var secs int
+	for _, v := range strings.Split(s.Duration, ":") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0
+		}
+
+		secs = secs*60 + n
+	}
+
+	return secs
 }
 
 type Artist struct {
@@ -37,29 +60,100 @@ type Thumbnail struct {
 }
 
 type text struct {
-	bufs     chan []byte
+	bufs     chan *canvas
 	ctx      context.Context
+	cancel   func()
 	disabled func() bool
 }
 
+// QueueState is a snapshot of a queue. Published snapshots are never modified,
+// and the slices in them are replaced rather than changed in place, so they can
+// be shared freely between goroutines.
+type QueueState struct {
+	Songs []Song
+	Index int
+
+	Repeat   RepeatMode
+	Shuffle  bool
+	Original []Song // The order of the songs before they were shuffled
+	Autoplay bool   // Whether related songs are added when the queue is about to run out
+	Pages    PageLoader
+
+	Party PartyState
+
+	Playing     bool
+	Loading     bool
+	Paused      bool
+	ElapsedSecs int
+	StartOffset int // Where in the song the current stream started
+
+	Lyrics     []lyricLine
+	ShowLyrics bool
+	Layout     string            // How the song is shown on the display, single line if empty
+	Progress   bool              // Whether the elapsed time and a progress bar are drawn over the song
+	Templates  map[string]string // The player's own now playing templates by layout
+
+	LastElapsedUpdate time.Time
+}
+
+// CurrentSong returns the song at the index, if there is one
+func (s QueueState) CurrentSong() (Song, bool) {
+	if s.Index < 0 || s.Index >= len(s.Songs) {
+		return Song{}, false
+	}
+
+	return s.Songs[s.Index], true
+}
+
+// CurrentChapter returns the index of the chapter currently playing, or -1 if there are none
+func (s QueueState) CurrentChapter() int {
+	song, ok := s.CurrentSong()
+	if !ok {
+		return -1
+	}
+
+	chapter := -1
+	for k, v := range song.Chapters {
+		if s.ElapsedSecs >= v.Start {
+			chapter = k
+		}
+	}
+
+	return chapter
+}
+
+// Queue is the playback state of a player. The state is owned by the event loop
+// started with Watch; everything else sends it commands and reads snapshots.
 type Queue struct {
 	Player player
 	Buffer *audioBufferWrapper
-	Texts  []text
 
-	Songs []Song
-	Index int
+	Texts   []text
+	textsMu sync.Mutex
 
-	CancelPlaying func()
-	Playing       bool
-	Loading       bool
-	Paused        bool
-	ElapsedSecs   int
+	// The last frame rendered, for previews
+	frame       *canvas
+	framePacked []byte
+	frameMu     sync.Mutex
 
-	LastElapsedUpdate time.Time
+	cmds  chan func(st *QueueState)
+	state atomic.Value // QueueState
+	done  chan struct{}
+	once  sync.Once
+
+	// Only accessed by the event loop
+	cancelLoad  func()
+	lastChapter int
+	lastLyric   int
+	lastSong    string
+	track       *HistoryEntry // The play being recorded for the history
+	radioSeed   string        // The song related songs were last fetched for
+	loadingPage bool
+	staleDSP    bool // Tone settings changed while paused, so the song is loaded again to carry on
 }
 
 var queues []*Queue
+var queuesMu sync.Mutex
 
 var metricQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "slimytm_queue_length",
@@ -76,6 +170,11 @@ var metricBufferLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help: "The current length of the audio buffer in bytes",
 }, []string{"player"})
 
+var metricBufferSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "slimytm_buffer_length_seconds",
+	Help: "The current length of the audio buffer in seconds",
+}, []string{"player"})
+
 var metricPlayState = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "slimytm_play_state",
 	Help: "The current state of play. 3=loading, 2=paused, 1=playing, 0=not_playing",
@@ -97,117 +196,462 @@ var metricWatchdogInvocations = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "The number of times the watchdog has been invocated to skip a song",
 }, []string{"player"})
 
-func (q *Queue) Watch() {
-	for {
-		// Update metrics
-		metricQueueLength.WithLabelValues(q.Player.GetName()).Set(float64(len(q.Songs)))
-		metricQueueIndex.WithLabelValues(q.Player.GetName()).Set(float64(q.Index))
+func newQueue() *Queue {
+	q := &Queue{
+		Buffer:      new(audioBufferWrapper),
+		cmds:        make(chan func(st *QueueState)),
+		done:        make(chan struct{}),
+		lastChapter: -1,
+		lastLyric:   -1,
+	}
+	q.state.Store(QueueState{Repeat: REPEAT_OFF})
 
-		if q.Buffer != nil {
-			metricBufferLength.WithLabelValues(q.Player.GetName()).Set(float64(q.Buffer.Len()))
-		} else {
-			metricBufferLength.WithLabelValues(q.Player.GetName()).Set(0)
+	return q
+}
+
+// addQueue registers the queue so that clients can find it. A queue left behind by
+// an earlier connection of the same player is replaced and retired.
+func addQueue(q *Queue) {
+	var old *Queue
+	queuesMu.Lock()
+	for k, v := range queues {
+		if v.Player.GetID() == q.Player.GetID() {
+			old = v
+			queues[k] = q
+			break
 		}
+	}
+	if old == nil {
+		queues = append(queues, q)
+	}
+	queuesMu.Unlock()
 
-		if q.Loading {
-			metricPlayState.WithLabelValues(q.Player.GetName()).Set(3)
-		} else if q.Paused {
-			metricPlayState.WithLabelValues(q.Player.GetName()).Set(2)
-		} else if q.Playing {
-			metricPlayState.WithLabelValues(q.Player.GetName()).Set(1)
-		} else {
-			metricPlayState.WithLabelValues(q.Player.GetName()).Set(0)
+	if old != nil {
+		logger.Infow("player reconnected, replacing its old queue",
+			"player", q.Player.GetName())
+		retireQueue(old)
+	}
+}
+
+// removeQueue unregisters the queue and stops its event loop
+func removeQueue(q *Queue) {
+	removed := false
+	queuesMu.Lock()
+	for k, v := range queues {
+		if v == q {
+			queues = append(queues[:k:k], queues[k+1:]...)
+			removed = true
+			break
 		}
+	}
+	queuesMu.Unlock()
 
-		if q.Playing && len(q.Songs) > 0 && q.Index >= 0 && q.Index < len(q.Songs) {
-			// There is a valid queue
-			metricSecondsPlayed.WithLabelValues(q.Player.GetName()).Add(0.1)
+	// A queue replaced by a newer connection has already been retired
+	if !removed {
+		closeTransferMenu(q)
+		q.Close()
+		return
+	}
 
-			songTimes := strings.Split(q.Songs[q.Index].Duration, ":")
-			mins, _ := strconv.Atoi(songTimes[0])
-			secs, _ := strconv.Atoi(songTimes[1])
+	retireQueue(q)
+}
 
-			// Check whether we have finished a song
-			if q.ElapsedSecs >= mins*60+secs-1 {
-				logger.Debug("reached end of song")
-				if q.Index+1 < len(q.Songs) {
-					logger.Debug("will play next song")
-					q.Next()
-				} else {
-					logger.Debug("reached end of queue")
-					q.Playing = false
-				}
-			}
+// retireQueue saves a queue that is no longer registered and stops its event loop
+func retireQueue(q *Queue) {
+	closeTransferMenu(q)
+	publishEvent(q.Player, EVENT_PLAYER_DISCONNECTED, Song{}, nil)
 
-			// Watchdog check
-			shouldBePlaying := q.Playing && !q.Paused && !q.Loading
-			if shouldBePlaying && time.Since(q.LastElapsedUpdate) > WATCHDOG_INTERVAL && q.Index+1 < len(q.Songs) {
-				metricWatchdogInvocations.WithLabelValues(q.Player.GetName()).Inc()
-				logger.Warn("watchdog invoked, skipping song")
+	// Keep the queue so it can be restored if the player comes back
+	saveQueues(q)
+	q.Close()
+}
 
-				q.Next()
-			}
+// allQueues returns a copy of the registered queues
+func allQueues() []*Queue {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	return append([]*Queue(nil), queues...)
+}
+
+// getQueue finds the queue for a player id, returning nil if there isn't one
+func getQueue(id string) *Queue {
+	for _, v := range allQueues() {
+		if v.Player.GetID() == id {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// getQueueByName finds the queue for a player name, returning nil if there isn't one
+func getQueueByName(name string) *Queue {
+	for _, v := range allQueues() {
+		if v.Player.GetName() == name {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// State returns the latest snapshot of the queue
+func (q *Queue) State() QueueState {
+	return q.state.Load().(QueueState)
+}
+
+// do runs f on the event loop and waits for it to finish. f must only use the
+// unexported methods that take the state, as calling an exported method would deadlock.
+func (q *Queue) do(f func(st *QueueState)) {
+	finished := make(chan struct{})
+	select {
+	case q.cmds <- func(st *QueueState) {
+		f(st)
+		close(finished)
+	}:
+		<-finished
+	case <-q.done:
+	}
+}
+
+// Close stops the event loop
+func (q *Queue) Close() {
+	q.once.Do(func() {
+		close(q.done)
+	})
+}
+
+// Watch runs the event loop, which owns the state of the queue
+func (q *Queue) Watch() {
+	st := q.State()
+	ticker := time.NewTicker(WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case f := <-q.cmds:
+			f(&st)
+		case <-ticker.C:
+			q.tick(&st)
+		case <-q.done:
+			q.endTrack(&st, ENDED_STOPPED)
+			q.stopPlaying(&st)
+			return
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		q.state.Store(st)
+	}
+}
+
+// tick updates metrics and checks the state of playback
+func (q *Queue) tick(st *QueueState) {
+	// Update metrics
+	metricQueueLength.WithLabelValues(q.Player.GetName()).Set(float64(len(st.Songs)))
+	metricQueueIndex.WithLabelValues(q.Player.GetName()).Set(float64(st.Index))
+
+	if q.Buffer != nil {
+		metricBufferLength.WithLabelValues(q.Player.GetName()).Set(float64(q.Buffer.Len()))
+		metricBufferSeconds.WithLabelValues(q.Player.GetName()).Set(float64(q.Buffer.Len()) / float64(q.Player.GetFormat().BytesPerSecond()))
+	} else {
+		metricBufferLength.WithLabelValues(q.Player.GetName()).Set(0)
+		metricBufferSeconds.WithLabelValues(q.Player.GetName()).Set(0)
+	}
+
+	if st.Loading {
+		metricPlayState.WithLabelValues(q.Player.GetName()).Set(3)
+	} else if st.Paused {
+		metricPlayState.WithLabelValues(q.Player.GetName()).Set(2)
+	} else if st.Playing {
+		metricPlayState.WithLabelValues(q.Player.GetName()).Set(1)
+	} else {
+		metricPlayState.WithLabelValues(q.Player.GetName()).Set(0)
+	}
+
+	song, ok := st.CurrentSong()
+	if !st.Playing || !ok {
+		return
+	}
+
+	// There is a valid queue
+	metricSecondsPlayed.WithLabelValues(q.Player.GetName()).Add(WATCH_INTERVAL.Seconds())
+	q.listenedTo(WATCH_INTERVAL)
+
+	// Fetch the lyrics whenever the song changes
+	if song.ID != q.lastSong {
+		q.lastSong = song.ID
+		q.loadLyrics(st, song)
+	}
+
+	// Let clients know when we cross into a new chapter or lyric
+	c, l := st.CurrentChapter(), st.CurrentLyric()
+	if c != q.lastChapter || l != q.lastLyric {
+		q.lastChapter, q.lastLyric = c, l
+		q.updateClients(st)
+	}
+
+	q.checkRadio(st, song)
+	q.checkPages(st)
+
+	// Check whether we have finished a song
+	duration := song.DurationSecs()
+	if duration > 0 && st.ElapsedSecs >= duration-1 {
+		logger.Debug("reached end of song")
+		q.finished(st, ENDED_COMPLETED)
+		return
+	}
+
+	// Watchdog check. Songs without a known duration only end by the player stopping
+	shouldBePlaying := st.Playing && !st.Paused && !st.Loading
+	if shouldBePlaying && time.Since(st.LastElapsedUpdate) > WATCHDOG_INTERVAL {
+		if duration == 0 {
+			logger.Debug("song of unknown duration has stopped playing")
+			q.finished(st, ENDED_COMPLETED)
+			return
+		}
+
+		metricWatchdogInvocations.WithLabelValues(q.Player.GetName()).Inc()
+		logger.Warn("watchdog invoked, skipping song")
+		q.endTrack(st, ENDED_WATCHDOG)
+		if st.hasNext() {
+			q.next(st)
+		} else {
+			q.stopPlaying(st)
+			q.updateClients(st)
+		}
+	}
+}
+
+// finished ends the current song and moves on to whatever plays after it
+func (q *Queue) finished(st *QueueState, reason string) {
+	q.endTrack(st, reason)
+	if st.Repeat == REPEAT_ONE {
+		logger.Debug("repeating song")
+		q.load(st, 0)
+	} else if st.hasNext() {
+		logger.Debug("will play next song")
+		q.next(st)
+	} else {
+		logger.Debug("reached end of queue")
+		st.Playing = false
+		q.updateClients(st)
 	}
 }
 
 func (q *Queue) Next() {
+	q.do(q.next)
+}
+
+func (q *Queue) next(st *QueueState) {
 	logger.Debugw("next song called",
-		"index", q.Index,
-		"queueLen", len(q.Songs))
+		"index", st.Index,
+		"queueLen", len(st.Songs))
 
-	q.Player.Stop()
-	if q.CancelPlaying != nil {
-		q.CancelPlaying()
+	// Skip to the next chapter if there is one
+	if c := st.CurrentChapter(); c >= 0 && c+1 < len(st.Songs[st.Index].Chapters) {
+		q.seek(st, st.Songs[st.Index].Chapters[c+1].Start)
+		return
 	}
 
-	q.Buffer.Reset()
-	q.Playing = false
-	q.Paused = false
-	q.Index++
-	q.LastElapsedUpdate = time.Now().Add(WATCHDOG_INTERVAL)
+	st.Index++
+	if st.Index >= len(st.Songs) && st.Repeat == REPEAT_ALL && len(st.Songs) > 0 {
+		logger.Debug("repeating queue")
+		st.Index = 0
+	}
 
 	// Don't run over the end of the queue
-	if q.Index < len(q.Songs) {
+	if st.Index < len(st.Songs) {
 		logger.Debug("loading next song")
-		q.Loading = true
-		q.UpdateClients()
-		q.CancelPlaying = q.Player.Play(q.Songs[q.Index].ID)
+		q.load(st, 0)
 	} else {
 		logger.Debug("no more songs left")
-		q.Reset()
+		q.reset(st)
 	}
 }
 
 func (q *Queue) Previous() {
+	q.do(q.previous)
+}
+
+func (q *Queue) previous(st *QueueState) {
 	logger.Debugw("previous song called",
-		"index", q.Index,
-		"queueLen", len(q.Songs))
+		"index", st.Index,
+		"queueLen", len(st.Songs))
 
-	q.Player.Stop()
-	if q.CancelPlaying != nil {
-		q.CancelPlaying()
+	if _, ok := st.CurrentSong(); !ok {
+		return
 	}
 
-	q.Buffer.Reset()
-	q.Playing = false
-	q.Paused = false
-	q.LastElapsedUpdate = time.Now().Add(WATCHDOG_INTERVAL)
+	// Go back to the start of this chapter, or to the previous chapter
+	if c := st.CurrentChapter(); c >= 0 {
+		chapters := st.Songs[st.Index].Chapters
+		if st.ElapsedSecs-chapters[c].Start >= 5 {
+			q.seek(st, chapters[c].Start)
+			return
+		} else if c > 0 {
+			q.seek(st, chapters[c-1].Start)
+			return
+		}
+	}
 
 	// Don't run off the end of the queue
-	if q.ElapsedSecs < 5 && q.Index > 0 {
-		q.Index--
+	if st.ElapsedSecs < 5 && st.Index > 0 {
+		st.Index--
+	}
+
+	q.load(st, 0)
+}
+
+// Seek restarts the current song from secs seconds in
+func (q *Queue) Seek(secs int) {
+	q.do(func(st *QueueState) {
+		q.seek(st, secs)
+	})
+}
+
+func (q *Queue) seek(st *QueueState, secs int) {
+	logger.Debugw("seek called",
+		"index", st.Index,
+		"secs", secs)
+
+	if _, ok := st.CurrentSong(); !ok {
+		return
+	}
+
+	q.load(st, secs)
+}
+
+// Replace replaces the songs in the queue and starts playing from index, in order
+func (q *Queue) Replace(songs []Song, index int) {
+	q.ReplacePaged(songs, index, PageLoader{})
+}
+
+// ReplacePaged replaces the songs in the queue with the first page of a playlist,
+// and starts playing from index. The rest of the pages are loaded as they are needed.
+func (q *Queue) ReplacePaged(songs []Song, index int, pages PageLoader) {
+	q.do(func(st *QueueState) {
+		st.Songs = songs
+		st.Pages = pages
+		st.Shuffle = false
+		st.Original = nil
+		st.Index = index
+
+		// Go straight to the song, as next would skip chapters of whatever was at index-1
+		if _, ok := st.CurrentSong(); ok {
+			q.load(st, 0)
+		} else {
+			q.reset(st)
+		}
+	})
+}
+
+// load stops whatever is playing and starts loading the current song from offset seconds in
+func (q *Queue) load(st *QueueState, offset int) {
+	// Seeking within a song carries on the same play, anything else ends it
+	if q.track != nil && (offset == 0 || q.track.Song.ID != st.Songs[st.Index].ID) {
+		q.endTrack(st, ENDED_SKIPPED)
+	}
+
+	q.stopPlaying(st)
+
+	q.staleDSP = false
+	st.Party.Votes = nil
+	st.Loading = true
+	st.ElapsedSecs = offset
+	st.StartOffset = offset
+	st.LastElapsedUpdate = time.Now().Add(WATCHDOG_INTERVAL)
+	q.updateClients(st)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancelLoad = cancel
+	videoID := st.Songs[st.Index].ID
+
+	// Loading takes a while, so wait for the song off the loop
+	go func() {
+		err := q.Player.Play(ctx, videoID, offset)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		logger.Errorw("unable to play song, skipping",
+			"video", videoID,
+			"err", err)
+		q.do(func(st *QueueState) {
+			if ctx.Err() != nil {
+				// Something else has already been loaded
+				return
+			}
+
+			q.endTrack(st, ENDED_ERROR)
+
+			q.next(st)
+		})
+	}()
+}
+
+// stopPlaying stops the player and cancels the current stream
+func (q *Queue) stopPlaying(st *QueueState) {
+	q.Player.Stop()
+	if q.cancelLoad != nil {
+		q.cancelLoad()
+		q.cancelLoad = nil
 	}
 
-	q.Loading = true
-	q.UpdateClients()
-	q.CancelPlaying = q.Player.Play(q.Songs[q.Index].ID)
+	q.Buffer.Reset()
+	st.Playing = false
+	st.Paused = false
+	st.Loading = false
+}
+
+// Started marks the current song as having started playing on the player
+func (q *Queue) Started() {
+	q.do(func(st *QueueState) {
+		st.Playing = true
+		st.Loading = false
+		q.beginTrack(st)
+		q.updateClients(st)
+	})
+}
+
+// UpdateElapsed records the seconds played since the current stream started, as reported by the player
+func (q *Queue) UpdateElapsed(secs int) {
+	q.do(func(st *QueueState) {
+		elapsed := st.StartOffset + secs
+		if st.ElapsedSecs != elapsed {
+			st.LastElapsedUpdate = time.Now()
+		}
+		st.ElapsedSecs = elapsed
+	})
+}
+
+// SetChapters stores the chapters of a video once its stream has been resolved
+func (q *Queue) SetChapters(videoID string, chapters []Chapter) {
+	q.do(func(st *QueueState) {
+		song, ok := st.CurrentSong()
+		if !ok || song.ID != videoID {
+			return
+		}
+
+		song.Chapters = chapters
+		songs := append([]Song(nil), st.Songs...)
+		songs[st.Index] = song
+		st.Songs = songs
+		q.updateClients(st)
+	})
 }
 
 func (q *Queue) Pause() {
-	if q.Paused {
+	q.do(q.pause)
+}
+
+func (q *Queue) pause(st *QueueState) {
+	// A restored queue hasn't started yet, so start it from where it was. The same goes
+	// for a song paused before tone settings changed, so they are heard.
+	if _, ok := st.CurrentSong(); ok && (!st.active() || (st.Paused && q.staleDSP)) {
+		q.load(st, st.ElapsedSecs)
+		return
+	}
+
+	if st.Paused {
 		q.Player.Unpause()
 		logger.Debug("queue unpaused")
 	} else {
@@ -215,69 +659,224 @@ func (q *Queue) Pause() {
 		logger.Debug("queue paused")
 	}
 
-	q.Paused = !q.Paused
-	q.Playing = !q.Playing
-	q.UpdateClients()
+	st.Paused = !st.Paused
+	st.Playing = !st.Playing
+	q.updateClients(st)
+
+	song, _ := st.CurrentSong()
+	if st.Paused {
+		publishEvent(q.Player, EVENT_PAUSED, song, nil)
+	} else {
+		publishEvent(q.Player, EVENT_UNPAUSED, song, nil)
+	}
 }
 
 func (q *Queue) Reset() {
+	q.do(q.reset)
+}
+
+func (q *Queue) reset(st *QueueState) {
 	logger.Debug("queue reset")
 
-	q.Player.Stop()
-	if q.CancelPlaying != nil {
-		q.CancelPlaying()
-	}
-	q.Buffer.Reset()
+	q.endTrack(st, ENDED_STOPPED)
+	q.stopPlaying(st)
+	st.Songs = []Song{}
+	st.Original = nil
+	st.Pages = PageLoader{}
+	st.Index = 0
+	st.ElapsedSecs = 0
+	st.StartOffset = 0
+	st.Lyrics = nil
+	q.updateClients(st)
+}
 
-	q.Songs = []Song{}
-	q.Index = 0
-	q.Paused = false
-	q.Playing = false
-	q.Loading = false
-	q.ElapsedSecs = 0
-	q.UpdateClients()
+// SetVolume sets the volume of the player
+func (q *Queue) SetVolume(volume int) {
+	q.do(func(st *QueueState) {
+		q.Player.SetVolume(volume)
+		q.updateClients(st)
+		q.volumeChanged(st)
+	})
 }
 
-// Returns the JSON representation of the current song
+// AdjustVolume changes the volume of the player by delta, returning the new volume
+func (q *Queue) AdjustVolume(delta int) (volume int) {
+	q.do(func(st *QueueState) {
+		q.Player.SetVolume(q.Player.GetVolume() + delta)
+		volume = q.Player.GetVolume()
+		q.updateClients(st)
+		q.volumeChanged(st)
+	})
+
+	return volume
+}
+
+func (q *Queue) volumeChanged(st *QueueState) {
+	song, _ := st.CurrentSong()
+	publishEvent(q.Player, EVENT_VOLUME_CHANGED, song, map[string]interface{}{"volume": q.Player.GetVolume()})
+}
+
+// SetDSP applies and saves the tone settings of the player. Settings applied by ffmpeg
+// restart the current song from where it is, so they are heard straight away.
+func (q *Queue) SetDSP(d DSPSettings) {
+	q.do(func(st *QueueState) {
+		restart := q.Player.SetDSP(d)
+		saveDSP(q.Player.GetID(), q.Player.GetDSP())
+		if restart && st.Playing {
+			q.seek(st, st.ElapsedSecs)
+			return
+		}
+		q.staleDSP = q.staleDSP || (restart && st.Paused)
+		q.updateClients(st)
+	})
+}
+
+// RestoreSettings puts back a player's saved settings when it connects, without saving them again
+func (q *Queue) RestoreSettings(c PersistentClient) {
+	q.do(func(st *QueueState) {
+		st.ShowLyrics = c.Lyrics
+		st.Autoplay = c.Autoplay
+		st.Progress = c.Progress
+		st.Templates = restoreTemplates(q.Player.GetName(), c.Templates)
+		if q.supportsLayout(c.Layout) {
+			st.Layout = c.Layout
+		} else if c.Layout != "" {
+			logger.Warnw("unable to restore layout",
+				"player", q.Player.GetName(),
+				"layout", c.Layout)
+		}
+		q.updateClients(st)
+	})
+}
+
+// Returns the JSON representation of the current song, as seen by a client in control
 func (q *Queue) CurrentSongJSON() []byte {
+	return q.stateJSON(q.State(), true)
+}
+
+// stateJSON describes the queue for a client, which is the host if it is in control in party mode
+func (q *Queue) stateJSON(st QueueState, host bool) []byte {
 	var song string
-	if q.Index < len(q.Songs) && len(q.Songs) > 0 && (q.Playing || q.Paused) {
-		b, _ := json.Marshal(q.Songs[q.Index])
+	if cur, ok := st.CurrentSong(); ok && (st.Playing || st.Paused) {
+		b, _ := json.Marshal(cur)
 		song = string(b)
 	} else {
 		song = "{}"
 	}
 
-	return []byte(fmt.Sprintf(`{"id": "%v", "name": "%v", "type": "%v", "song": %v, "paused": %v, "loading": %v, "volume": %v}`,
-		q.Player.GetID(), q.Player.GetName(), q.Player.GetModel(), song, q.Paused, q.Loading, q.Player.GetVolume(),
+	dsp, _ := json.Marshal(q.Player.GetDSP())
+	lyrics, _ := json.Marshal(st.Lyrics)
+	songs, _ := json.Marshal(st.Songs)
+	layouts, _ := json.Marshal(q.layouts())
+
+	// Templates in use for each layout, so they can be edited
+	shown := make(map[string]string)
+	for k := range defaultTemplates {
+		shown[k] = st.displayTemplate(k)
+	}
+	templates, _ := json.Marshal(shown)
+	layout := st.Layout
+	if layout == "" {
+		layout = LAYOUT_SINGLE
+	}
+
+	return []byte(fmt.Sprintf(`{"id": "%v", "name": "%v", "type": "%v", "song": %v, "chapter": %v, "paused": %v, "loading": %v, "volume": %v, "dsp": %s, "lyrics": %s, "lyric": %v, "showLyrics": %v, "queue": %s, "index": %v, "repeat": "%v", "shuffle": %v, "autoplay": %v, "total": %v, "party": %s, "layout": "%v", "layouts": %s, "progress": %v, "templates": %s}`,
+		q.Player.GetID(), q.Player.GetName(), q.Player.GetModel(), song, st.CurrentChapter(), st.Paused, st.Loading, q.Player.GetVolume(), dsp,
+		lyrics, st.CurrentLyric(), st.ShowLyrics, songs, st.Index, st.Repeat, st.Shuffle, st.Autoplay, st.TotalHint(), q.partyJSON(st, host), layout, layouts, st.Progress, templates,
 	))
 }
 
-// Returns buffers with the current song name
-func (q *Queue) CurrentSongBuf() chan []byte {
-	var curText string
-	var curBuf chan []byte
-	out := make(chan []byte)
+// Returns buffers with the current song name, until the context is cancelled
+func (q *Queue) CurrentSongBuf(ctx context.Context) chan *canvas {
+	var curText, curKey string
+	var curBuf chan *canvas
+	var textUpdates chan string
+	var lineUpdates chan [2]string
+	cancel := func() {}
+	out := make(chan *canvas)
+	templates := make(map[string]*template.Template) // Parsed templates by their text
 
 	go func() {
+		// The text being shown stops along with this
+		defer func() { cancel() }()
+
 		for {
-			if len(q.Songs) == 0 || q.Index < 0 || q.Index >= len(q.Songs) {
-				time.Sleep(100 * time.Millisecond)
+			st := q.State()
+			song, ok := st.CurrentSong()
+			if !ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
 				continue
 			}
 
-			songsStr := fmt.Sprintf("%v from %v by %v",
-				q.Songs[q.Index].Title,
-				q.Songs[q.Index].Album.Name,
-				q.Songs[q.Index].Artists[0].Name,
-			)
+			// Two lines are shown with the first line of the template on top
+			lines, twoLine := q.Player.(lineDisplay)
+			twoLine = twoLine && st.Layout == LAYOUT_TWO_LINE
+			layout := LAYOUT_SINGLE
+			if twoLine {
+				layout = LAYOUT_TWO_LINE
+			}
+
+			songsStr := q.nowPlayingText(st, song, layout, templates)
+			if !twoLine {
+				songsStr = strings.ReplaceAll(songsStr, "\n", " ")
+			}
+
+			top, bottom, _ := strings.Cut(songsStr, "\n")
+			bottom = strings.ReplaceAll(bottom, "\n", " ")
+
+			// Text scrolls from the start for each song, while changes like the elapsed
+			// time carry on from the same point
+			key := fmt.Sprintf("%v/%v/%v", song.ID, st.CurrentChapter(), layout)
+			if curKey != key {
+				// Stop the old text from scrolling forever
+				cancel()
 
-			if curText != songsStr {
-				curBuf = q.Player.DisplayText(songsStr, context.Background())
+				var textCtx context.Context
+				textCtx, cancel = context.WithCancel(ctx)
+				if twoLine {
+					lineUpdates = make(chan [2]string)
+					curBuf = lines.DisplayLines(top, bottom, lineUpdates, textCtx)
+				} else {
+					textUpdates = make(chan string)
+					curBuf = q.Player.DisplayText(songsStr, textUpdates, textCtx)
+				}
+				curKey, curText = key, songsStr
+			} else if curText != songsStr {
+				if twoLine {
+					select {
+					case <-ctx.Done():
+						return
+					case lineUpdates <- [2]string{top, bottom}:
+					}
+				} else {
+					select {
+					case <-ctx.Done():
+						return
+					case textUpdates <- songsStr:
+					}
+				}
 				curText = songsStr
 			}
 
-			out <- <-curBuf
+			var buf *canvas
+			select {
+			case <-ctx.Done():
+				return
+			case buf = <-curBuf:
+			}
+			if st.Progress {
+				buf = drawProgress(buf, st.ElapsedSecs, song.DurationSecs())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- buf:
+			}
 		}
 	}()
 
@@ -286,50 +885,116 @@ func (q *Queue) CurrentSongBuf() chan []byte {
 
 // Update all clients
 func (q *Queue) UpdateClients() {
-	s := q.CurrentSongJSON()
+	q.sendState(q.State())
+}
+
+func (q *Queue) updateClients(st *QueueState) {
+	q.sendState(*st)
+}
+
+// sendState sends the state to every client, telling the host of a party apart from the guests
+func (q *Queue) sendState(st QueueState) {
+	host := q.stateJSON(st, true)
+	guest := host
+	if st.Party.Enabled {
+		guest = q.stateJSON(st, false)
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
 	for _, v := range clients {
-		v.Conn.WriteMessage(websocket.TextMessage, s)
+		if st.Party.isGuest(v.hostTokens[q.Player.GetID()]) {
+			v.Send(guest)
+		} else {
+			v.Send(host)
+		}
+	}
+}
+
+// PushText displays text on top of everything else until it expires or is dismissed
+func (q *Queue) PushText(msg string, d time.Duration) (dismiss func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+
+	q.textsMu.Lock()
+	defer q.textsMu.Unlock()
+	q.Texts = append(q.Texts, text{
+		bufs:   q.Player.DisplayText(msg, nil, ctx),
+		ctx:    ctx,
+		cancel: cancel,
+	})
+
+	return cancel
+}
+
+// topText finds the top enabled element, removing any that have expired
+func (q *Queue) topText() text {
+	q.textsMu.Lock()
+	defer q.textsMu.Unlock()
+
+	for {
+		i := len(q.Texts) - 1
+		for q.Texts[i].disabled != nil && q.Texts[i].disabled() {
+			i--
+		}
+
+		top := q.Texts[i]
+		if top.ctx.Err() == nil {
+			return top
+		}
+
+		// The context has been cancelled/timed out, remove it and try again
+		if top.cancel != nil {
+			top.cancel()
+		}
+		q.Texts = append(q.Texts[:i:i], q.Texts[i+1:]...)
 	}
 }
 
 func (q *Queue) Composite() {
+	// Everything drawn for the display stops along with the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Clock will always be displayed with the lowest priority, queue starts disabled
-	q.Texts = []text{
+	q.textsMu.Lock()
+	q.Texts = append([]text{
 		{
-			bufs: q.Player.DisplayClock(),
+			bufs: q.Player.DisplayClock(ctx),
 			ctx:  context.Background(),
 		},
 		{
-			bufs:     q.Player.DisplayText("Loading...", context.Background()),
+			bufs:     q.Player.DisplayText("Loading...", nil, ctx),
 			ctx:      context.Background(),
-			disabled: func() bool { return !q.Loading },
+			disabled: func() bool { return !q.State().Loading },
 		},
 		{
-			bufs:     q.CurrentSongBuf(),
+			bufs:     q.CurrentSongBuf(ctx),
 			ctx:      context.Background(),
-			disabled: func() bool { return !q.Playing },
+			disabled: func() bool { return !q.State().Playing },
 		},
-	}
+		{
+			bufs: q.LyricsBuf(ctx),
+			ctx:  context.Background(),
+			disabled: func() bool {
+				st := q.State()
+				return !st.Playing || !st.ShowLyrics || st.CurrentLyric() < 0
+			},
+		},
+	}, q.Texts...)
+	q.textsMu.Unlock()
 
 	frameTime := time.Now()
 	for {
-		top := q.Texts[len(q.Texts)-1]
-
-		// Find the top enabled element
-		i := 1
-		for top.disabled != nil && top.disabled() {
-			i++
-			top = q.Texts[len(q.Texts)-i]
-		}
-
-		if top.ctx.Err() != nil {
-			// The context has been cancelled/timed out, remove it and try again
-			q.Texts = append(q.Texts[:len(q.Texts)-i], q.Texts[len(q.Texts)-i+1:]...)
-			continue
+		select {
+		case <-q.done:
+			return
+		default:
 		}
 
 		// Render the top buffer
-		q.Player.Render(<-top.bufs)
+		frame := <-q.topText().bufs
+		q.Player.Render(frame)
+		q.rendered(frame)
 		metricFrameTiming.WithLabelValues(q.Player.GetName()).Observe(float64(time.Since(frameTime)) / float64(time.Second))
 		frameTime = time.Now()
 
@@ -337,3 +1002,137 @@ func (q *Queue) Composite() {
 		time.Sleep(time.Millisecond * 33)
 	}
 }
+
+// active returns whether a song is playing, paused or loading
+func (s QueueState) active() bool {
+	_, ok := s.CurrentSong()
+	return ok && (s.Playing || s.Paused || s.Loading)
+}
+
+// checkIndex ensures index is in the queue and, if videoID is given, that it is still the same song
+func (s QueueState) checkIndex(index int, videoID string) error {
+	if index < 0 || index >= len(s.Songs) {
+		return fmt.Errorf("index %v is not in the queue", index)
+	}
+
+	if videoID != "" && s.Songs[index].ID != videoID {
+		return fmt.Errorf("song at index %v is no longer %v", index, videoID)
+	}
+
+	return nil
+}
+
+// Enqueue adds songs to the end of the queue, or after the current song if next is set.
+// The songs start playing if nothing else is.
+func (q *Queue) Enqueue(songs []Song, next bool) {
+	if len(songs) == 0 {
+		return
+	}
+
+	q.do(func(st *QueueState) {
+		q.enqueue(st, songs, next)
+	})
+}
+
+func (q *Queue) enqueue(st *QueueState, songs []Song, next bool) {
+	pos := len(st.Songs)
+	if next && st.active() {
+		pos = st.Index + 1
+	}
+
+	updated := make([]Song, 0, len(st.Songs)+len(songs))
+	updated = append(updated, st.Songs[:pos]...)
+	updated = append(updated, songs...)
+	updated = append(updated, st.Songs[pos:]...)
+
+	wasActive := st.active()
+	st.addOriginal(songs, next && wasActive)
+	st.Songs = updated
+	if !wasActive {
+		st.Index = pos
+		q.load(st, 0)
+		return
+	}
+
+	q.updateClients(st)
+}
+
+// Remove removes the song at index from the queue. If it is the current song,
+// the next song starts playing.
+func (q *Queue) Remove(index int, videoID string) (err error) {
+	q.do(func(st *QueueState) {
+		err = st.checkIndex(index, videoID)
+		if err != nil {
+			return
+		}
+
+		wasActive := st.active()
+		st.Songs = append(st.Songs[:index:index], st.Songs[index+1:]...)
+
+		if index < st.Index {
+			st.Index--
+		} else if index == st.Index && wasActive {
+			if st.Index < len(st.Songs) {
+				q.load(st, 0)
+				return
+			}
+
+			q.endTrack(st, ENDED_SKIPPED)
+			q.stopPlaying(st)
+		}
+
+		q.updateClients(st)
+	})
+
+	return err
+}
+
+// Move moves the song at from so that it is at to
+func (q *Queue) Move(from, to int, videoID string) (err error) {
+	q.do(func(st *QueueState) {
+		err = st.checkIndex(from, videoID)
+		if err == nil {
+			err = st.checkIndex(to, "")
+		}
+		if err != nil {
+			return
+		}
+
+		song := st.Songs[from]
+		songs := append(st.Songs[:from:from], st.Songs[from+1:]...)
+		songs = append(songs[:to:to], append([]Song{song}, songs[to:]...)...)
+		st.Songs = songs
+
+		// Keep the index pointing at the current song
+		if from == st.Index {
+			st.Index = to
+		} else if from < st.Index && to >= st.Index {
+			st.Index--
+		} else if from > st.Index && to <= st.Index {
+			st.Index++
+		}
+
+		q.updateClients(st)
+	})
+
+	return err
+}
+
+// Clear removes everything from the queue except the current song
+func (q *Queue) Clear() {
+	q.do(func(st *QueueState) {
+		cur, ok := st.CurrentSong()
+		if !ok || !st.active() {
+			q.reset(st)
+			return
+		}
+
+		st.Songs = []Song{cur}
+		st.Index = 0
+		st.Pages = PageLoader{}
+		if st.Shuffle {
+			st.Original = []Song{cur}
+		}
+		q.updateClients(st)
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakePlayer is a player without a device, which starts playing as soon as it is told to
+type fakePlayer struct {
+	id    string
+	queue *Queue
+
+	mu     sync.Mutex
+	volume int
+	dsp    DSPSettings
+	played []string
+}
+
+func (p *fakePlayer) GetID() string    { return p.id }
+func (p *fakePlayer) GetModel() string { return "Fake" }
+func (p *fakePlayer) GetName() string  { return p.id }
+func (p *fakePlayer) Listener()        {}
+func (p *fakePlayer) Heartbeat()       {}
+
+func (p *fakePlayer) DisplayClock(ctx context.Context) chan *canvas {
+	return displayClock(SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, blankFont(8, 16), ctx)
+}
+
+func (p *fakePlayer) DisplayText(text string, updates chan string, ctx context.Context) chan *canvas {
+	return displayText(SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, blankFont(8, 16), text, updates, ctx)
+}
+
+func (p *fakePlayer) Render(c *canvas) {}
+
+func (p *fakePlayer) Play(ctx context.Context, videoID string, offset int) error {
+	p.mu.Lock()
+	p.played = append(p.played, videoID)
+	p.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	p.queue.Started()
+	return nil
+}
+
+func (p *fakePlayer) Stop()                  {}
+func (p *fakePlayer) GetFormat() audioFormat { return defaultFormat }
+func (p *fakePlayer) Pause()                 {}
+func (p *fakePlayer) Unpause()               {}
+
+func (p *fakePlayer) SetVolume(volume int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.volume = volume
+}
+
+func (p *fakePlayer) GetVolume() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.volume
+}
+
+func (p *fakePlayer) SetDSP(d DSPSettings) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	restart := d.Filters(false) != p.dsp.Filters(false)
+	p.dsp = d
+	return restart
+}
+
+func (p *fakePlayer) GetDSP() DSPSettings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dsp
+}
+
+// Played returns the videos the player has been told to play, in order
+func (p *fakePlayer) Played() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.played...)
+}
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// testEnv runs the test in an empty directory, so nothing is written to the working tree
+func testEnv(t *testing.T) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// newTestQueue starts a queue on a fake player, which is stopped at the end of the test
+func newTestQueue(t *testing.T, id string) (*Queue, *fakePlayer) {
+	t.Helper()
+
+	p := &fakePlayer{id: id}
+	q := newQueue()
+	q.Player = p
+	p.queue = q
+
+	// Wait for the loop to finish, so it doesn't outlive the test
+	stopped := make(chan struct{})
+	go func() {
+		q.Watch()
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		q.Close()
+		<-stopped
+	})
+
+	return q, p
+}
+
+func testSongs(prefix string, n int) []Song {
+	var songs []Song
+	for i := 0; i < n; i++ {
+		songs = append(songs, Song{
+			ID:       fmt.Sprintf("%v%d", prefix, i),
+			Title:    fmt.Sprintf("Song %d", i),
+			Artists:  []Artist{{Name: "Artist"}},
+			Duration: "3:00",
+		})
+	}
+
+	return songs
+}
+
+func TestQueueConcurrentUse(t *testing.T) {
+	testEnv(t)
+	q, _ := newTestQueue(t, "concurrent")
+	go q.Composite()
+
+	// A websocket client receiving every update
+	c := &Client{send: make(chan []byte, CLIENT_SEND_BUFFER)}
+	addClient(c)
+	t.Cleanup(func() { removeClient(c) })
+	go func() {
+		for range c.send {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				switch j % 6 {
+				case 0:
+					q.Enqueue(testSongs(fmt.Sprintf("g%d-%d-", i, j), 3), j%2 == 0)
+				case 1:
+					q.Next()
+				case 2:
+					q.SetVolume(i*10 + j)
+				case 3:
+					st := q.State()
+					st.CurrentSong()
+					q.CurrentSongJSON()
+				case 4:
+					q.ToggleShuffle()
+				case 5:
+					q.Previous()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	st := q.State()
+	if st.Index < 0 || st.Index > len(st.Songs) {
+		t.Fatalf("index %v is outside a queue of %v songs", st.Index, len(st.Songs))
+	}
+}
+
+func TestAddQueueReplacesReconnectedPlayer(t *testing.T) {
+	testEnv(t)
+	old, _ := newTestQueue(t, "reconnect")
+	addQueue(old)
+	old.Replace(testSongs("s", 2), 1)
+
+	q, _ := newTestQueue(t, "reconnect")
+	addQueue(q)
+	t.Cleanup(func() { removeQueue(q) })
+
+	if getQueue("reconnect") != q {
+		t.Fatal("player id still finds the old queue")
+	}
+
+	// The old queue is saved for the new connection to restore, and stopped
+	savedQueuesMu.Lock()
+	saved := savedQueues["reconnect"]
+	savedQueuesMu.Unlock()
+	if len(saved.Songs) != 2 || saved.Index != 1 {
+		t.Fatalf("saved %v songs at %v, want 2 at 1", len(saved.Songs), saved.Index)
+	}
+	select {
+	case <-old.done:
+	default:
+		t.Fatal("old queue is still running")
+	}
+
+	// The old connection going away later leaves the new queue alone
+	removeQueue(old)
+	if getQueue("reconnect") != q {
+		t.Fatal("removing the old queue removed the new one")
+	}
+}
+
+// waitFor polls until the condition holds, failing the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
+
+func TestSetDSPRestartsSong(t *testing.T) {
+	testEnv(t)
+	q, p := newTestQueue(t, "dsp")
+	q.Replace(testSongs("s", 2), 0)
+	waitFor(t, "the song to play", func() bool { return q.State().Playing })
+
+	// Balance doesn't need the song loading again, but the equaliser does
+	q.SetDSP(DSPSettings{Balance: 50})
+	q.SetDSP(DSPSettings{Balance: 50, EQ: []EQBand{{Frequency: 1000, Gain: 3}}})
+	waitFor(t, "the song to restart", func() bool { return len(p.Played()) == 2 })
+	if got := fmt.Sprint(p.Played()); got != "[s0 s0]" {
+		t.Fatalf("played %v", got)
+	}
+
+	// Changes while paused are heard once the song carries on
+	waitFor(t, "the song to play", func() bool { return q.State().Playing })
+	q.Pause()
+	q.SetDSP(DSPSettings{})
+	if len(p.Played()) != 2 {
+		t.Fatal("paused song was restarted")
+	}
+	q.Pause()
+	waitFor(t, "the song to carry on", func() bool { return len(p.Played()) == 3 })
+}
+
+func TestDisplayFramesDontDropState(t *testing.T) {
+	testEnv(t)
+	q, _ := newTestQueue(t, "frames")
+	addQueue(q)
+	t.Cleanup(func() { removeQueue(q) })
+
+	c := &Client{send: make(chan []byte, CLIENT_SEND_BUFFER), framesReady: make(chan struct{}, 1)}
+	addClient(c)
+	t.Cleanup(func() { removeClient(c) })
+	c.watchDisplay(q, true)
+
+	// Many more frames than fit in the send buffer, without the client reading any
+	for i := 0; i < CLIENT_SEND_BUFFER*2; i++ {
+		frame := newCanvas(8, 1)
+		frame.pix[i%8] = true
+		q.rendered(frame)
+	}
+	q.UpdateClients()
+
+	if len(c.send) != 1 {
+		t.Fatalf("%v messages queued, want only the state", len(c.send))
+	}
+	frames := c.takeFrames()
+	if len(frames) != 1 || !strings.Contains(string(frames["frames"]), `"frame":"AQ=="`) {
+		t.Fatalf("kept frames %q", frames)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+const (
+	RADIO_PREFETCH_SECS = 30  // How long before the queue runs out to add related songs
+	RADIO_RECENT_PLAYS  = 100 // How many of the player's recent plays are not added again
+)
+
+// SetAutoplay turns autoplay on or off and saves the choice
+func (q *Queue) SetAutoplay(on bool) {
+	q.do(func(st *QueueState) {
+		q.setAutoplay(st, on)
+	})
+}
+
+// ToggleAutoplay turns autoplay on or off and saves the choice, returning whether it is now on
+func (q *Queue) ToggleAutoplay() (on bool) {
+	q.do(func(st *QueueState) {
+		q.setAutoplay(st, !st.Autoplay)
+		on = st.Autoplay
+	})
+
+	return on
+}
+
+func (q *Queue) setAutoplay(st *QueueState, on bool) {
+	st.Autoplay = on
+	updatePersistentClient(q.Player.GetID(), func(c *PersistentClient) {
+		c.Autoplay = on
+	})
+	q.updateClients(st)
+}
+
+// checkRadio fetches songs related to the last song in the queue when it is nearly
+// finished, and adds them to the end of the queue
+func (q *Queue) checkRadio(st *QueueState, song Song) {
+	if !st.radioDue(song) || q.radioSeed == song.ID {
+		return
+	}
+
+	q.radioSeed = song.ID
+	player := q.Player.GetID()
+	go func() {
+		songs, err := catalog.Related(song.ID)
+		if err != nil {
+			logger.Warnw("unable to retrieve related songs",
+				"video", song.ID,
+				"err", err)
+			return
+		}
+
+		// Don't play anything that has been heard recently
+		recent := make(map[string]bool)
+		plays, _ := queryHistory(historyFilter{Player: player}, 0, RADIO_RECENT_PLAYS)
+		for _, v := range plays {
+			recent[v.Song.ID] = true
+		}
+
+		q.do(func(st *QueueState) {
+			cur, ok := st.CurrentSong()
+			if !st.Autoplay || !ok || cur.ID != song.ID || st.Index+1 < len(st.Songs) {
+				// The queue has changed since, so these songs aren't wanted
+				return
+			}
+
+			for _, v := range st.Songs {
+				recent[v.ID] = true
+			}
+
+			fresh := freshSongs(songs, recent)
+
+			logger.Infow("adding related songs to the queue",
+				"video", song.ID,
+				"songs", len(fresh))
+			if len(fresh) > 0 {
+				q.enqueue(st, fresh, false)
+			}
+		})
+	}()
+}
+
+// radioDue returns whether related songs should be added after song, which is playing
+// last in the queue, as the queue is about to run out
+func (s QueueState) radioDue(song Song) bool {
+	if !s.Autoplay || s.Repeat != REPEAT_OFF || s.Index+1 < len(s.Songs) || s.Pages.More() {
+		return false
+	}
+
+	duration := song.DurationSecs()
+	return duration <= 0 || duration-s.ElapsedSecs <= RADIO_PREFETCH_SECS
+}
+
+// freshSongs returns the songs that aren't in seen, once each, adding them to it
+func freshSongs(songs []Song, seen map[string]bool) []Song {
+	var fresh []Song
+	for _, v := range songs {
+		if !seen[v.ID] {
+			seen[v.ID] = true
+			fresh = append(fresh, v)
+		}
+	}
+
+	return fresh
+}
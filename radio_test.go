@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestRadioDue(t *testing.T) {
+	song := Song{ID: "last", Duration: "3:00"}
+	for _, v := range []struct {
+		name string
+		st   QueueState
+		song Song
+		want bool
+	}{
+		{"nearly finished", QueueState{Autoplay: true, Songs: []Song{song}, ElapsedSecs: 150}, song, true},
+		{"just in time", QueueState{Autoplay: true, Songs: []Song{song}, ElapsedSecs: 180 - RADIO_PREFETCH_SECS}, song, true},
+		{"too early", QueueState{Autoplay: true, Songs: []Song{song}, ElapsedSecs: 60}, song, false},
+		{"unknown duration", QueueState{Autoplay: true, Songs: []Song{song}}, Song{ID: "last", Duration: "live"}, true},
+		{"autoplay off", QueueState{Songs: []Song{song}, ElapsedSecs: 170}, song, false},
+		{"repeating", QueueState{Autoplay: true, Repeat: REPEAT_ALL, Songs: []Song{song}, ElapsedSecs: 170}, song, false},
+		{"songs after it", QueueState{Autoplay: true, Songs: []Song{song, {ID: "next"}}, ElapsedSecs: 170}, song, false},
+		{"last of several", QueueState{Autoplay: true, Songs: []Song{{ID: "first"}, song}, Index: 1, ElapsedSecs: 170}, song, true},
+		{"pages still to load", QueueState{Autoplay: true, Songs: []Song{song}, ElapsedSecs: 170, Pages: PageLoader{QueueType: "playlist", Next: 1}}, song, false},
+		{"every page loaded", QueueState{Autoplay: true, Songs: []Song{song}, ElapsedSecs: 170, Pages: PageLoader{QueueType: "playlist", Next: 1, Total: 1}}, song, true},
+	} {
+		// Queues start with repeat off rather than unset
+		if v.st.Repeat == "" {
+			v.st.Repeat = REPEAT_OFF
+		}
+		if got := v.st.radioDue(v.song); got != v.want {
+			t.Errorf("%v: due %v, want %v", v.name, got, v.want)
+		}
+	}
+}
+
+func TestFreshSongs(t *testing.T) {
+	for _, v := range []struct {
+		name    string
+		related string
+		seen    string
+		want    string
+	}{
+		{"nothing seen", "a b c", "", "[a b c]"},
+		{"recently played left out", "a b c", "b", "[a c]"},
+		{"repeats left out", "a b a c b", "", "[a b c]"},
+		{"everything seen", "a b", "a b c", "[]"},
+		{"nothing related", "", "a", "[]"},
+	} {
+		seen := make(map[string]bool)
+		for _, s := range songsFrom(v.seen) {
+			seen[s.ID] = true
+		}
+
+		got := freshSongs(songsFrom(v.related), seen)
+		if songIDs(got) != v.want {
+			t.Errorf("%v: kept %v, want %v", v.name, songIDs(got), v.want)
+		}
+		for _, s := range got {
+			if !seen[s.ID] {
+				t.Errorf("%v: %v wasn't marked as seen", v.name, s.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	QUEUES_LOCATION     = "slimytm_queues.json"
+	QUEUE_SAVE_INTERVAL = time.Second * 30
+)
+
+// SavedQueue is what is kept of a queue across restarts
+type SavedQueue struct {
+	Songs       []Song     `json:"songs"`
+	Index       int        `json:"index"`
+	ElapsedSecs int        `json:"elapsedSecs"`
+	Repeat      RepeatMode `json:"repeat"`
+	Shuffle     bool       `json:"shuffle"`
+	Original    []Song     `json:"original,omitempty"`
+	Volume      *int       `json:"volume,omitempty"` // Nil if the volume wasn't saved, as 0 is muted
+	Pages       PageLoader `json:"pages"`
+}
+
+// Map of player ids to their last saved queue
+var savedQueues = make(map[string]SavedQueue)
+var savedQueuesMu sync.Mutex
+
+// loadQueues reads the queues saved by the last run, if there are any
+func loadQueues() {
+	savedQueuesMu.Lock()
+	defer savedQueuesMu.Unlock()
+
+	b, err := os.ReadFile(QUEUES_LOCATION)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.Errorw("unable to read saved queues",
+			"location", QUEUES_LOCATION,
+			"err", err)
+		return
+	}
+
+	err = json.Unmarshal(b, &savedQueues)
+	if err != nil {
+		logger.Errorw("unable to parse saved queues",
+			"location", QUEUES_LOCATION,
+			"err", err)
+	}
+}
+
+// queueSaver periodically saves every queue, so little is lost if the server crashes
+func queueSaver() {
+	for range time.Tick(QUEUE_SAVE_INTERVAL) {
+		saveQueues(allQueues()...)
+	}
+}
+
+// saveQueues records the state of the queues and writes all saved queues to disk.
+// Players that aren't connected keep whatever was saved for them last.
+func saveQueues(queues ...*Queue) {
+	savedQueuesMu.Lock()
+	defer savedQueuesMu.Unlock()
+
+	for _, v := range queues {
+		savedQueues[v.Player.GetID()] = v.Saved()
+	}
+
+	b, err := json.Marshal(savedQueues)
+	if err != nil {
+		logger.Errorw("unable to encode saved queues",
+			"err", err)
+		return
+	}
+
+	// Write to a temporary file first so a crash can't leave a half written file
+	tmp := QUEUES_LOCATION + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, QUEUES_LOCATION)
+	}
+	if err != nil {
+		logger.Errorw("unable to save queues",
+			"location", QUEUES_LOCATION,
+			"err", err)
+	}
+}
+
+// Saved returns the parts of the queue that are kept across restarts
+func (q *Queue) Saved() SavedQueue {
+	return q.saved(q.State())
+}
+
+// Take returns the saved queue and resets it, so it can be moved somewhere else.
+// playing is whether the queue was playing and not paused.
+func (q *Queue) Take() (saved SavedQueue, playing bool) {
+	q.do(func(st *QueueState) {
+		saved = q.saved(*st)
+		playing = st.active() && !st.Paused
+		q.reset(st)
+	})
+
+	return saved, playing
+}
+
+func (q *Queue) saved(st QueueState) SavedQueue {
+	volume := q.Player.GetVolume()
+	return SavedQueue{
+		Songs:       st.Songs,
+		Index:       st.Index,
+		ElapsedSecs: st.ElapsedSecs,
+		Repeat:      st.Repeat,
+		Shuffle:     st.Shuffle,
+		Original:    st.Original,
+		Volume:      &volume,
+		Pages:       st.Pages,
+	}
+}
+
+// restoreQueue puts back the queue a player had before the server restarted or it
+// disconnected, resuming playback if the player is set to
+func restoreQueue(q *Queue) {
+	savedQueuesMu.Lock()
+	saved, ok := savedQueues[q.Player.GetID()]
+	savedQueuesMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	logger.Infow("restoring saved queue",
+		"player", q.Player.GetName(),
+		"songs", len(saved.Songs),
+		"index", saved.Index)
+	q.Restore(saved, getPersistentClient(q.Player.GetID()).AutoResume)
+}
+
+// Restore replaces the queue with a saved one. If resume is set and there is a
+// current song, it starts playing from where it was saved.
+func (q *Queue) Restore(saved SavedQueue, resume bool) {
+	q.do(func(st *QueueState) {
+		if saved.Volume != nil {
+			q.Player.SetVolume(*saved.Volume)
+		}
+
+		mode, err := parseRepeatMode(string(saved.Repeat))
+		if err != nil {
+			mode = REPEAT_OFF
+		}
+
+		q.stopPlaying(st)
+		st.Songs = saved.Songs
+		st.Index = saved.Index
+		st.Repeat = mode
+		st.Shuffle = saved.Shuffle
+		st.Original = saved.Original
+		st.Pages = saved.Pages
+		st.ElapsedSecs = saved.ElapsedSecs
+		st.StartOffset = saved.ElapsedSecs
+
+		if _, ok := st.CurrentSong(); ok && resume {
+			q.load(st, saved.ElapsedSecs)
+			return
+		}
+
+		q.updateClients(st)
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SCROBBLE_URL     = "https://api.listenbrainz.org"
+	SCROBBLE_QUEUE_LOCATION  = "slimytm_scrobbles.json"
+	SCROBBLE_RETRY_INTERVAL  = time.Minute
+	SCROBBLE_TIMEOUT         = time.Second * 10
+	SCROBBLE_MAX_SECS        = 240  // Songs are scrobbled after half their length or this long, whichever comes first
+	SCROBBLE_MAX_BATCH       = 100  // The most listens sent in one request when catching up
+	SCROBBLE_MAX_PENDING     = 1000 // The most listens kept to retry, dropping the oldest
+	SCROBBLE_SUBMISSION_PATH = "/1/submit-listens"
+)
+
+// ScrobbleConfig is where a player or user submits their listens
+type ScrobbleConfig struct {
+	URL   string `json:"url"` // A ListenBrainz compatible server, the public one if empty
+	Token string `json:"token"`
+	User  string `json:"user"` // For players, scrobble as this user from scrobbleUsers instead
+}
+
+type listen struct {
+	ListenedAt    int64         `json:"listened_at,omitempty"`
+	TrackMetadata trackMetadata `json:"track_metadata"`
+}
+
+type trackMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info,omitempty"`
+}
+
+// pendingListen is a listen that couldn't be submitted yet. Credentials are looked
+// up again when it is retried, so they aren't written anywhere else.
+type pendingListen struct {
+	Player string `json:"player"`
+	Listen listen `json:"listen"`
+}
+
+var pendingListens []pendingListen
+var pendingListensMu sync.Mutex
+
+var scrobbleClient = &http.Client{Timeout: SCROBBLE_TIMEOUT}
+
+// errRetry marks failures that are worth trying again later
+var errRetry = errors.New("scrobble server unavailable")
+
+// scrobbleConfig returns where a player's listens go, if it scrobbles at all
+func scrobbleConfig(playerID string) (ScrobbleConfig, bool) {
+	persistentMu.Lock()
+	defer persistentMu.Unlock()
+
+	c := persistent.Clients[playerID].Scrobble
+	if c.User != "" {
+		c = persistent.ScrobbleUsers[c.User]
+	}
+
+	if c.URL == "" {
+		c.URL = DEFAULT_SCROBBLE_URL
+	}
+
+	return c, c.Token != ""
+}
+
+// newListen describes a song for the scrobble server
+func newListen(song Song) listen {
+	var artists []string
+	for _, v := range song.Artists {
+		artists = append(artists, v.Name)
+	}
+
+	l := listen{TrackMetadata: trackMetadata{
+		ArtistName:  strings.Join(artists, ", "),
+		TrackName:   song.Title,
+		ReleaseName: song.Album.Name,
+		AdditionalInfo: map[string]interface{}{
+			"media_player":      "SlimYTM",
+			"submission_client": "SlimYTM",
+		},
+	}}
+
+	if secs := song.DurationSecs(); secs > 0 {
+		l.TrackMetadata.AdditionalInfo["duration_ms"] = secs * 1000
+	}
+	if videoIDRegex.MatchString(song.ID) {
+		l.TrackMetadata.AdditionalInfo["origin_url"] = "https://music.youtube.com/watch?v=" + song.ID
+	}
+
+	return l
+}
+
+// scrobbleAfter returns how long a song has to be listened to before it is scrobbled
+func scrobbleAfter(song Song) time.Duration {
+	secs := song.DurationSecs() / 2
+	if secs <= 0 || secs > SCROBBLE_MAX_SECS {
+		secs = SCROBBLE_MAX_SECS
+	}
+
+	return time.Duration(secs) * time.Second
+}
+
+// submitListens sends listens of a type (playing_now, single or import) to the server
+func submitListens(c ScrobbleConfig, listenType string, listens []listen) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"listen_type": listenType,
+		"payload":     listens,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URL, "/")+SCROBBLE_SUBMISSION_PATH, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := scrobbleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRetry, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return fmt.Errorf("%w: %v", errRetry, resp.Status)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("scrobble server returned %v", resp.Status)
+	}
+
+	return nil
+}
+
+// scrobbleNowPlaying tells the server what a player has started playing. It isn't
+// retried, as it would be out of date by then.
+func scrobbleNowPlaying(playerID string, song Song) {
+	c, ok := scrobbleConfig(playerID)
+	if !ok {
+		return
+	}
+
+	go func() {
+		err := submitListens(c, "playing_now", []listen{newListen(song)})
+		if err != nil {
+			logger.Debugw("unable to submit now playing",
+				"video", song.ID,
+				"err", err)
+		}
+	}()
+}
+
+// scrobble submits a listen, keeping it to try again later if the server can't be reached
+func scrobble(playerID string, song Song, start time.Time) {
+	c, ok := scrobbleConfig(playerID)
+	if !ok {
+		return
+	}
+
+	l := newListen(song)
+	l.ListenedAt = start.Unix()
+
+	go func() {
+		err := submitListens(c, "single", []listen{l})
+		if errors.Is(err, errRetry) {
+			logger.Infow("unable to scrobble, will retry",
+				"video", song.ID,
+				"err", err)
+
+			addPendingListen(pendingListen{Player: playerID, Listen: l})
+		} else if err != nil {
+			logger.Warnw("unable to scrobble",
+				"video", song.ID,
+				"err", err)
+		}
+	}()
+}
+
+// loadPendingListens reads the listens that couldn't be submitted by the last run
+func loadPendingListens() {
+	pendingListensMu.Lock()
+	defer pendingListensMu.Unlock()
+
+	b, err := os.ReadFile(SCROBBLE_QUEUE_LOCATION)
+	if os.IsNotExist(err) {
+		return
+	} else if err == nil {
+		err = json.Unmarshal(b, &pendingListens)
+	}
+	if err != nil {
+		logger.Errorw("unable to read pending scrobbles",
+			"location", SCROBBLE_QUEUE_LOCATION,
+			"err", err)
+	}
+
+	trimPendingListens()
+}
+
+// addPendingListen keeps a listen to retry later, and saves the listens waiting
+func addPendingListen(p pendingListen) {
+	pendingListensMu.Lock()
+	defer pendingListensMu.Unlock()
+
+	pendingListens = append(pendingListens, p)
+	trimPendingListens()
+	savePendingListens()
+}
+
+// trimPendingListens drops the oldest listens past the limit. Must be called with pendingListensMu held
+func trimPendingListens() {
+	if over := len(pendingListens) - SCROBBLE_MAX_PENDING; over > 0 {
+		logger.Warnw("too many pending scrobbles, dropping the oldest",
+			"dropped", over)
+		pendingListens = pendingListens[over:]
+	}
+}
+
+// savePendingListens writes the listens waiting to be submitted. Must be called with pendingListensMu held
+func savePendingListens() {
+	b, err := json.Marshal(pendingListens)
+	if err == nil {
+		err = os.WriteFile(SCROBBLE_QUEUE_LOCATION, b, 0644)
+	}
+	if err != nil {
+		logger.Errorw("unable to save pending scrobbles",
+			"location", SCROBBLE_QUEUE_LOCATION,
+			"err", err)
+	}
+}
+
+// scrobbleRetrier periodically submits the listens that couldn't be submitted before
+func scrobbleRetrier() {
+	for range time.Tick(SCROBBLE_RETRY_INTERVAL) {
+		retryPendingListens()
+	}
+}
+
+// retryPendingListens submits the pending listens, keeping any that still can't be
+// submitted in the order they were listened to
+func retryPendingListens() {
+	// Take the listens, so any that fail while retrying go after them
+	pendingListensMu.Lock()
+	pending := pendingListens
+	pendingListens = nil
+	pendingListensMu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	// Send each player's listens together
+	byPlayer := make(map[string][]listen)
+	for _, v := range pending {
+		byPlayer[v.Player] = append(byPlayer[v.Player], v.Listen)
+	}
+
+	done := make(map[string]int) // How many of each player's listens have been sent or dropped
+	for player, listens := range byPlayer {
+		c, ok := scrobbleConfig(player)
+		if !ok {
+			logger.Warnw("dropping pending scrobbles for player without credentials",
+				"player", player,
+				"listens", len(listens))
+			done[player] = len(listens)
+			continue
+		}
+
+		for len(listens) > 0 {
+			batch := listens
+			if len(batch) > SCROBBLE_MAX_BATCH {
+				batch = batch[:SCROBBLE_MAX_BATCH]
+			}
+
+			err := submitListens(c, "import", batch)
+			if errors.Is(err, errRetry) {
+				break
+			} else if err != nil {
+				logger.Warnw("dropping pending scrobbles",
+					"player", player,
+					"listens", len(batch),
+					"err", err)
+			}
+
+			done[player] += len(batch)
+			listens = listens[len(batch):]
+		}
+	}
+
+	// Keep the rest of each player's listens, in their original order
+	var failed []pendingListen
+	seen := make(map[string]int)
+	for _, v := range pending {
+		if seen[v.Player] >= done[v.Player] {
+			failed = append(failed, v)
+		}
+		seen[v.Player]++
+	}
+
+	logger.Infow("retried pending scrobbles",
+		"pending", len(pending),
+		"failed", len(failed))
+
+	pendingListensMu.Lock()
+	pendingListens = append(failed, pendingListens...)
+	trimPendingListens()
+	savePendingListens()
+	pendingListensMu.Unlock()
+}
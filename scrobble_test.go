@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// scrobbleStub is a scrobble server that records what is submitted, failing for the
+// tokens in fail with their status
+type scrobbleStub struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	fail       map[string]int
+	submitted  map[string][]string // Track names by token
+	listenType string
+}
+
+func newScrobbleStub(t *testing.T) *scrobbleStub {
+	t.Helper()
+
+	s := &scrobbleStub{fail: make(map[string]int), submitted: make(map[string][]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != SCROBBLE_SUBMISSION_PATH || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var body struct {
+			ListenType string   `json:"listen_type"`
+			Payload    []listen `json:"payload"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		token := r.Header.Get("Authorization")
+		if status, ok := s.fail[token]; ok {
+			w.WriteHeader(status)
+			return
+		}
+
+		s.listenType = body.ListenType
+		for _, v := range body.Payload {
+			s.submitted[token] = append(s.submitted[token], v.TrackMetadata.TrackName)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *scrobbleStub) setFail(token string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status == 0 {
+		delete(s.fail, "Token "+token)
+		return
+	}
+	s.fail["Token "+token] = status
+}
+
+func (s *scrobbleStub) tracks(token string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprint(s.submitted["Token "+token])
+}
+
+// usePlayers sets the persistent data of players for the test
+func usePlayers(t *testing.T, clients map[string]PersistentClient) {
+	t.Helper()
+
+	persistentMu.Lock()
+	old := persistent.Clients
+	persistent.Clients = clients
+	persistentMu.Unlock()
+
+	t.Cleanup(func() {
+		persistentMu.Lock()
+		persistent.Clients = old
+		persistentMu.Unlock()
+	})
+}
+
+// usePendingListens sets the listens waiting to be retried for the test
+func usePendingListens(t *testing.T, pending []pendingListen) {
+	t.Helper()
+
+	pendingListensMu.Lock()
+	pendingListens = pending
+	pendingListensMu.Unlock()
+
+	t.Cleanup(func() {
+		pendingListensMu.Lock()
+		pendingListens = nil
+		pendingListensMu.Unlock()
+	})
+}
+
+func pendingTracks() string {
+	pendingListensMu.Lock()
+	defer pendingListensMu.Unlock()
+
+	var tracks []string
+	for _, v := range pendingListens {
+		tracks = append(tracks, v.Player+":"+v.Listen.TrackMetadata.TrackName)
+	}
+
+	return fmt.Sprint(tracks)
+}
+
+func testListen(title string) listen {
+	return newListen(Song{ID: title, Title: title, Artists: []Artist{{Name: "Artist"}}})
+}
+
+func TestSubmitListens(t *testing.T) {
+	s := newScrobbleStub(t)
+	c := ScrobbleConfig{URL: s.URL + "/", Token: "token"}
+
+	err := submitListens(c, "single", []listen{testListen("one")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.tracks("token") != "[one]" || s.listenType != "single" {
+		t.Fatalf("submitted %v as %v", s.tracks("token"), s.listenType)
+	}
+
+	// Servers that are busy or broken are retried, anything else isn't
+	for status, retry := range map[int]bool{http.StatusTooManyRequests: true, http.StatusServiceUnavailable: true, http.StatusBadRequest: false, http.StatusUnauthorized: false} {
+		s.setFail("token", status)
+		err := submitListens(c, "single", []listen{testListen("two")})
+		if err == nil || errors.Is(err, errRetry) != retry {
+			t.Errorf("status %v returned %v, want retry %v", status, err, retry)
+		}
+	}
+
+	// As are servers that can't be reached
+	s.Close()
+	err = submitListens(c, "single", []listen{testListen("three")})
+	if !errors.Is(err, errRetry) {
+		t.Fatalf("unreachable server returned %v", err)
+	}
+}
+
+func TestRetryPendingListens(t *testing.T) {
+	testEnv(t)
+	s := newScrobbleStub(t)
+	usePlayers(t, map[string]PersistentClient{
+		"a": {Scrobble: ScrobbleConfig{URL: s.URL, Token: "a"}},
+		"b": {Scrobble: ScrobbleConfig{URL: s.URL, Token: "b"}},
+	})
+	usePendingListens(t, []pendingListen{
+		{Player: "b", Listen: testListen("b1")},
+		{Player: "a", Listen: testListen("a1")},
+		{Player: "b", Listen: testListen("b2")},
+		{Player: "gone", Listen: testListen("gone1")},
+		{Player: "a", Listen: testListen("a2")},
+	})
+
+	// Listens that still fail are kept in order, and those without credentials are dropped
+	s.setFail("b", http.StatusServiceUnavailable)
+	retryPendingListens()
+	if s.tracks("a") != "[a1 a2]" || s.listenType != "import" {
+		t.Fatalf("submitted %v as %v", s.tracks("a"), s.listenType)
+	}
+	if got := pendingTracks(); got != "[b:b1 b:b2]" {
+		t.Fatalf("kept %v", got)
+	}
+
+	// Listens that fail while retrying go after them
+	addPendingListen(pendingListen{Player: "b", Listen: testListen("b3")})
+	s.setFail("b", 0)
+	retryPendingListens()
+	if s.tracks("b") != "[b1 b2 b3]" || pendingTracks() != "[]" {
+		t.Fatalf("submitted %v, kept %v", s.tracks("b"), pendingTracks())
+	}
+
+	// Errors that won't go away drop the listens
+	usePendingListens(t, []pendingListen{{Player: "a", Listen: testListen("a3")}})
+	s.setFail("a", http.StatusBadRequest)
+	retryPendingListens()
+	if got := pendingTracks(); got != "[]" {
+		t.Fatalf("kept %v", got)
+	}
+}
+
+func TestPendingListensAreCapped(t *testing.T) {
+	testEnv(t)
+	usePendingListens(t, nil)
+
+	for i := 0; i < SCROBBLE_MAX_PENDING+5; i++ {
+		addPendingListen(pendingListen{Player: "a", Listen: testListen(fmt.Sprint(i))})
+	}
+
+	pendingListensMu.Lock()
+	defer pendingListensMu.Unlock()
+	if len(pendingListens) != SCROBBLE_MAX_PENDING || pendingListens[0].Listen.TrackMetadata.TrackName != "5" {
+		t.Fatalf("kept %v listens from %v", len(pendingListens), pendingListens[0].Listen.TrackMetadata.TrackName)
+	}
+}
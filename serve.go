@@ -3,9 +3,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"image/png"
 	"io"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -27,15 +33,12 @@ var logger *zap.SugaredLogger
 func audio(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	for _, v := range queues {
-		if fmt.Sprint(v.Player.GetID()) == vars["id"] {
-			logger.Debugw("new audio request",
-				"player", v.Player.GetID(),
-				"bufLen", v.Buffer.Len(),
-				"bufSecs", v.Buffer.Len()/44100/2/2)
-			io.Copy(w, v.Buffer)
-			return
-		}
+	if v := getQueue(vars["id"]); v != nil {
+		logger.Debugw("new audio request",
+			"player", v.Player.GetID(),
+			"bufLen", v.Buffer.Len(),
+			"bufSecs", v.Buffer.Len()/v.Player.GetFormat().BytesPerSecond())
+		io.Copy(w, v.Buffer)
 	}
 }
 
@@ -50,7 +53,7 @@ func getPlayers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var out []resp
-	for _, v := range queues {
+	for _, v := range allQueues() {
 		out = append(out, resp{
 			ID:   v.Player.GetID(),
 			Type: v.Player.GetModel(),
@@ -79,9 +82,8 @@ func ws(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add the client to our list
-	c := &Client{Conn: conn}
-	clients = append(clients, c)
-	metricConnectedClients.Inc()
+	c := newClient(conn)
+	addClient(c)
 
 	// Set the close handler on the ws connection
 	conn.SetCloseHandler(func(code int, text string) error {
@@ -90,37 +92,531 @@ func ws(w http.ResponseWriter, r *http.Request) {
 		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
 
 		// Remove the client from our list
-		for k, v := range clients {
-			if v == c {
-				clients = append(clients[:k], clients[k+1:]...)
-			}
-		}
+		removeClient(c)
 
 		return nil
 	})
 
 	// Update the client with all player states
-	for _, v := range queues {
+	for _, v := range allQueues() {
 		v.UpdateClients()
 	}
 
+	go c.Writer()
 	go c.Listener()
 }
 
+// Handle playing videos by id or url. Accepts multiple ids/urls or a playlist url
+// in the vid parameter, either repeated or comma separated.
 func loadVidID(w http.ResponseWriter, r *http.Request) {
 	playerID := r.URL.Query().Get("player")
-	videoID := r.URL.Query().Get("vid")
 
-	var queue *Queue
-	for _, v := range queues {
-		if v.Player.GetID() == playerID {
-			queue = v
+	queue := getQueue(playerID)
+	if queue == nil {
+		writeError(w, http.StatusNotFound, "unknown player "+playerID)
+		return
+	}
+
+	var refs []string
+	for _, v := range r.URL.Query()["vid"] {
+		for _, ref := range strings.Split(v, ",") {
+			if strings.TrimSpace(ref) != "" {
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	if len(refs) == 0 {
+		writeError(w, http.StatusBadRequest, "no video ids given")
+		return
+	}
+
+	// Fetch the metadata for everything before touching the queue. A playlist at the
+	// end is loaded a page at a time, while earlier ones are loaded in full so the
+	// songs after them stay in order.
+	var songs []Song
+	var pages PageLoader
+	var errs []string
+	for k, ref := range refs {
+		videoID, playlistID, err := parseMediaRef(ref)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if playlistID != "" {
+			s, p, err := firstPage("playlist", playlistID)
+			for err == nil && k < len(refs)-1 && p.More() {
+				var page []Song
+				page, p, err = p.fetch()
+				s = append(s, page...)
+			}
+			if err != nil {
+				logger.Warnw("unable to retrieve playlist",
+					"playlist", playlistID,
+					"err", err)
+				errs = append(errs, fmt.Sprintf("playlist %v: %v", playlistID, err))
+				continue
+			}
+
+			songs = append(songs, s...)
+			pages = p
+		} else {
+			s, err := catalog.Song(videoID)
+			if err != nil {
+				logger.Warnw("unable to retrieve song metadata",
+					"video", videoID,
+					"err", err)
+				errs = append(errs, fmt.Sprintf("video %v: %v", videoID, err))
+				continue
+			}
+
+			songs = append(songs, s)
+		}
+	}
+
+	if len(songs) == 0 {
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{"error": "unable to retrieve any songs", "errors": errs})
+		return
+	}
+
+	queue.ReplacePaged(songs, 0, pages)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"songs": songs, "errors": errs})
+}
+
+// requestQueue finds the queue for the player in the url, responding with an error if there isn't one
+func requestQueue(w http.ResponseWriter, r *http.Request) *Queue {
+	id := mux.Vars(r)["id"]
+
+	queue := getQueue(id)
+	if queue == nil {
+		writeError(w, http.StatusNotFound, "unknown player "+id)
+	}
+
+	return queue
+}
+
+// queueResponse responds with the songs in a queue and the current index
+func queueResponse(w http.ResponseWriter, queue *Queue) {
+	st := queue.State()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"songs": st.Songs, "index": st.Index})
+}
+
+// Handle clients getting the queue of a player
+func getQueueSongs(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	queueResponse(w, queue)
+}
+
+// Handle adding a song, album or playlist to a queue. Songs are added after
+// the current song rather than at the end if next=true is set.
+func enqueue(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	var e EnqueueEvent
+	err := json.NewDecoder(r.Body).Decode(&e)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = enqueueSongs(queue, e, r.URL.Query().Get("next") == "true")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	queueResponse(w, queue)
+}
+
+// Handle removing a song from a queue. The videoId parameter can be given to
+// make sure the song at the index is the one expected.
+func removeFromQueue(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid index")
+		return
+	}
+
+	err = queue.Remove(index, r.URL.Query().Get("videoId"))
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	queueResponse(w, queue)
+}
+
+// Handle moving a song within a queue
+func moveInQueue(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	var e QueueEditEvent
+	err := json.NewDecoder(r.Body).Decode(&e)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = queue.Move(e.From, e.To, e.VideoID)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	queueResponse(w, queue)
+}
+
+// Handle clearing everything but the current song from a queue
+func clearQueue(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	queue.Clear()
+	queueResponse(w, queue)
+}
+
+// playModeResponse responds with the repeat and shuffle modes of a queue
+func playModeResponse(w http.ResponseWriter, queue *Queue) {
+	st := queue.State()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"repeat": st.Repeat, "shuffle": st.Shuffle})
+}
+
+// Handle setting the repeat mode of a queue with mode=off|one|all, or cycling it if no mode is given
+func setRepeat(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		queue.CycleRepeat()
+		playModeResponse(w, queue)
+		return
+	}
+
+	m, err := parseRepeatMode(mode)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	queue.SetRepeat(m)
+	playModeResponse(w, queue)
+}
+
+// Handle turning shuffle on or off with enabled=true|false, or toggling it if not given
+func setShuffle(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	enabled := r.URL.Query().Get("enabled")
+	if enabled == "" {
+		queue.ToggleShuffle()
+		playModeResponse(w, queue)
+		return
+	}
+
+	shuffle, err := strconv.ParseBool(enabled)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "enabled must be true or false")
+		return
+	}
+
+	queue.SetShuffle(shuffle)
+	playModeResponse(w, queue)
+}
+
+// Handle clients querying the history. Filters are player, videoId, reason,
+// since and until (RFC 3339). Newest plays come first, paged with limit and offset.
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := historyFilter{
+		Player:  query.Get("player"),
+		VideoID: query.Get("videoId"),
+		Reason:  query.Get("reason"),
+	}
+
+	var err error
+	if v := query.Get("since"); v != "" {
+		f.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		f.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "until must be an RFC 3339 time")
+			return
+		}
+	}
+
+	limit := DEFAULT_HISTORY_LIMIT
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if limit > MAX_HISTORY_LIMIT {
+			limit = MAX_HISTORY_LIMIT
+		}
+	}
+
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "invalid offset")
+			return
 		}
 	}
 
-	queue.Songs = []Song{{ID: videoID, Artists: []Artist{{Name: "idk"}}}}
-	queue.Index = -1
-	queue.Next()
+	entries, total := queryHistory(f, offset, limit)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": total, "offset": offset, "entries": entries})
+}
+
+// Handle turning the progress overlay on or off with enabled=true|false, or toggling it if not given
+func setProgress(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	enabled := r.URL.Query().Get("enabled")
+	if enabled == "" {
+		queue.ToggleProgress()
+	} else {
+		on, err := strconv.ParseBool(enabled)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+
+		queue.SetProgress(on)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"progress": queue.State().Progress})
+}
+
+// Handle setting the now playing template of a layout, resetting it to the default if empty
+func setTemplate(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	layout := r.URL.Query().Get("layout")
+	if layout == "" {
+		layout = LAYOUT_SINGLE
+	}
+
+	err := queue.SetTemplate(layout, r.URL.Query().Get("template"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"layout": layout, "template": queue.State().displayTemplate(layout)})
+}
+
+// Handle a snapshot of what is on the player's display, with each pixel scale pixels square
+func displaySnapshot(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	scale := PREVIEW_SCALE
+	if v := r.URL.Query().Get("scale"); v != "" {
+		var err error
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > PREVIEW_MAX_SCALE {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("scale must be between 1 and %d", PREVIEW_MAX_SCALE))
+			return
+		}
+	}
+
+	frame := queue.Frame()
+	if frame == nil {
+		writeError(w, http.StatusNotFound, "nothing has been shown on the display yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	err := png.Encode(w, frame.Image(scale))
+	if err != nil {
+		logger.Debugw("unable to send display snapshot",
+			"err", err)
+	}
+}
+
+// Handle choosing how the song is laid out on the player's display
+func setLayout(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	err := queue.SetLayout(r.URL.Query().Get("layout"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"layout": queue.State().Layout})
+}
+
+// Handle turning autoplay on or off with enabled=true|false, or toggling it if not given
+func setAutoplay(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	enabled := r.URL.Query().Get("enabled")
+	if enabled == "" {
+		queue.ToggleAutoplay()
+	} else {
+		on, err := strconv.ParseBool(enabled)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "enabled must be true or false")
+			return
+		}
+
+		queue.SetAutoplay(on)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"autoplay": queue.State().Autoplay})
+}
+
+// Handle moving the queue of a player to the player given by id or name in to
+func transfer(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	to := r.URL.Query().Get("to")
+	target := findQueue(to)
+	if target == nil {
+		writeError(w, http.StatusNotFound, "unknown player "+to)
+		return
+	}
+
+	err := transferQueue(queue, target)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	queueResponse(w, target)
+}
+
+// Handle clients browsing the playlists in the catalog
+func browseCatalog(w http.ResponseWriter, r *http.Request) {
+	playlists, err := catalog.Browse()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, playlists)
+}
+
+// Handle clients getting a playlist from the catalog, optionally paged with start and limit
+func catalogPlaylist(w http.ResponseWriter, r *http.Request) {
+	start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if start < 0 || limit < 0 {
+		writeError(w, http.StatusBadRequest, "invalid start or limit")
+		return
+	}
+
+	p, err := catalog.Playlist(mux.Vars(r)["id"], start, limit)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+// Handle turning party mode on or off with enabled=true|false. The vote share is the share
+// of clients needed to skip a song. The token returned lets a client identify as the host.
+func setParty(w http.ResponseWriter, r *http.Request) {
+	queue := requestQueue(w, r)
+	if queue == nil {
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "enabled must be true or false")
+		return
+	}
+
+	var share float64
+	if v := r.URL.Query().Get("voteShare"); v != "" {
+		share, err = strconv.ParseFloat(v, 64)
+		if err != nil || share <= 0 || share > 1 {
+			writeError(w, http.StatusBadRequest, "voteShare must be more than 0 and at most 1")
+			return
+		}
+	}
+
+	var token string
+	if enabled {
+		token = newPartyToken()
+	}
+
+	queue.SetParty(enabled, token, share)
+	party := queue.State().Party
+	writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": party.Enabled, "voteShare": party.VoteShare, "token": token})
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Errorw("unable to encode response",
+			"err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeError responds with a json error message
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
 }
 
 // A middleware to cope for any CORS requests
@@ -160,6 +656,34 @@ func main() {
 	logger = l.Sugar()
 	logger.Info("slimytm is starting")
 
+	catalog, err = newCatalog(persistent.Catalog)
+	if err != nil {
+		logger.Panicw("unable to create catalog",
+			"type", persistent.Catalog.Type,
+			"err", err)
+	}
+
+	loadHistory()
+	go historyWriter()
+	loadPendingListens()
+	go scrobbleRetrier()
+	startHooks(persistent.Hooks)
+
+	// Save the queues when we are asked to stop, and every so often in case we crash
+	loadQueues()
+	go queueSaver()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		logger.Info("slimytm is stopping")
+		saveQueues(allQueues()...)
+		flushHistory()
+		l.Sync()
+		os.Exit(0)
+	}()
+
 	// Start slimproto listeners
 	go udpListener()
 	go tcpListener()
@@ -176,6 +700,23 @@ func main() {
 	r.Path("/ws").HandlerFunc(ws)
 	r.Path("/metrics").Handler(promhttp.Handler())
 	r.Path("/playID").HandlerFunc(loadVidID)
+	r.Path("/player/{id}/queue").Methods("GET").HandlerFunc(getQueueSongs)
+	r.Path("/player/{id}/queue").Methods("POST", "OPTIONS").HandlerFunc(enqueue)
+	r.Path("/player/{id}/queue/move").Methods("POST", "OPTIONS").HandlerFunc(moveInQueue)
+	r.Path("/player/{id}/queue/clear").Methods("POST", "OPTIONS").HandlerFunc(clearQueue)
+	r.Path("/player/{id}/queue/{index:[0-9]+}").Methods("DELETE", "OPTIONS").HandlerFunc(removeFromQueue)
+	r.Path("/player/{id}/repeat").Methods("POST", "OPTIONS").HandlerFunc(setRepeat)
+	r.Path("/player/{id}/shuffle").Methods("POST", "OPTIONS").HandlerFunc(setShuffle)
+	r.Path("/player/{id}/transfer").Methods("POST", "OPTIONS").HandlerFunc(transfer)
+	r.Path("/player/{id}/party").Methods("POST", "OPTIONS").HandlerFunc(setParty)
+	r.Path("/player/{id}/progress").Methods("POST", "OPTIONS").HandlerFunc(setProgress)
+	r.Path("/player/{id}/template").Methods("POST", "OPTIONS").HandlerFunc(setTemplate)
+	r.Path("/player/{id}/display.png").Methods("GET").HandlerFunc(displaySnapshot)
+	r.Path("/player/{id}/layout").Methods("POST", "OPTIONS").HandlerFunc(setLayout)
+	r.Path("/player/{id}/autoplay").Methods("POST", "OPTIONS").HandlerFunc(setAutoplay)
+	r.Path("/catalog/playlists").HandlerFunc(browseCatalog)
+	r.Path("/catalog/playlist/{id}").HandlerFunc(catalogPlaylist)
+	r.Path("/history").HandlerFunc(getHistory)
 
 	logger.Panicw("unable to start http server",
 		"port", 9001,
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+type RepeatMode string
+
+const (
+	REPEAT_OFF RepeatMode = "off"
+	REPEAT_ONE RepeatMode = "one" // The current song plays again when it finishes
+	REPEAT_ALL RepeatMode = "all" // The queue starts again from the top when it finishes
+)
+
+// Next returns the mode after this one, for cycling through them from a single button
+func (r RepeatMode) Next() RepeatMode {
+	switch r {
+	case REPEAT_ALL:
+		return REPEAT_ONE
+	case REPEAT_ONE:
+		return REPEAT_OFF
+	default:
+		return REPEAT_ALL
+	}
+}
+
+// parseRepeatMode checks that a mode from a client is one we know about
+func parseRepeatMode(mode string) (RepeatMode, error) {
+	switch RepeatMode(mode) {
+	case REPEAT_OFF, REPEAT_ONE, REPEAT_ALL:
+		return RepeatMode(mode), nil
+	case "":
+		return REPEAT_OFF, nil
+	default:
+		return "", fmt.Errorf("unknown repeat mode %q", mode)
+	}
+}
+
+// hasNext returns whether there is a song to move on to after the current one
+func (s QueueState) hasNext() bool {
+	return s.Index+1 < len(s.Songs) || (s.Repeat == REPEAT_ALL && len(s.Songs) > 0)
+}
+
+// SetRepeat sets the repeat mode of the queue
+func (q *Queue) SetRepeat(mode RepeatMode) {
+	q.do(func(st *QueueState) {
+		st.Repeat = mode
+		q.updateClients(st)
+	})
+}
+
+// CycleRepeat moves the queue to the next repeat mode, returning the new mode
+func (q *Queue) CycleRepeat() (mode RepeatMode) {
+	q.do(func(st *QueueState) {
+		st.Repeat = st.Repeat.Next()
+		mode = st.Repeat
+		q.updateClients(st)
+	})
+
+	return mode
+}
+
+// SetShuffle turns shuffle on or off without interrupting the current song
+func (q *Queue) SetShuffle(shuffle bool) {
+	q.do(func(st *QueueState) {
+		q.setShuffle(st, shuffle)
+	})
+}
+
+// ToggleShuffle turns shuffle on or off, returning whether it is now on
+func (q *Queue) ToggleShuffle() (shuffle bool) {
+	q.do(func(st *QueueState) {
+		q.setShuffle(st, !st.Shuffle)
+		shuffle = st.Shuffle
+	})
+
+	return shuffle
+}
+
+func (q *Queue) setShuffle(st *QueueState, shuffle bool) {
+	if shuffle && !st.Shuffle {
+		st.shuffle()
+	} else if !shuffle && st.Shuffle {
+		st.unshuffle()
+	}
+
+	q.updateClients(st)
+}
+
+// shuffle remembers the order of the queue and shuffles it, keeping the current song first
+func (s *QueueState) shuffle() {
+	s.Shuffle = true
+	s.Original = s.Songs
+
+	cur, ok := s.CurrentSong()
+	if !ok {
+		return
+	}
+
+	rest := make([]Song, 0, len(s.Songs))
+	rest = append(rest, s.Songs[:s.Index]...)
+	rest = append(rest, s.Songs[s.Index+1:]...)
+	rand.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+
+	s.Songs = append([]Song{cur}, rest...)
+	s.Index = 0
+}
+
+// unshuffle puts the queue back in its original order. Songs removed while shuffled
+// stay removed, and songs added while shuffled go at the end.
+func (s *QueueState) unshuffle() {
+	s.Shuffle = false
+
+	// Count what is still in the queue, so duplicates are kept the right number of times
+	remaining := make(map[string]int)
+	for _, v := range s.Songs {
+		remaining[v.ID]++
+	}
+
+	cur, hasCurrent := s.CurrentSong()
+
+	songs := make([]Song, 0, len(s.Songs))
+	index := -1
+	for _, v := range s.Original {
+		if remaining[v.ID] == 0 {
+			continue
+		}
+
+		remaining[v.ID]--
+		if hasCurrent && index < 0 && v.ID == cur.ID {
+			index = len(songs)
+			v = cur
+		}
+		songs = append(songs, v)
+	}
+
+	for _, v := range s.Songs {
+		if remaining[v.ID] > 0 {
+			remaining[v.ID]--
+			if hasCurrent && index < 0 && v.ID == cur.ID {
+				index = len(songs)
+			}
+			songs = append(songs, v)
+		}
+	}
+
+	s.Songs = songs
+	s.Original = nil
+	if index >= 0 {
+		s.Index = index
+	}
+}
+
+// addOriginal records songs added while shuffled in the original order, either at
+// the end or after the current song
+func (s *QueueState) addOriginal(songs []Song, next bool) {
+	if !s.Shuffle {
+		return
+	}
+
+	pos := len(s.Original)
+	if cur, ok := s.CurrentSong(); ok && next {
+		for k, v := range s.Original {
+			if v.ID == cur.ID {
+				pos = k + 1
+				break
+			}
+		}
+	}
+
+	original := make([]Song, 0, len(s.Original)+len(songs))
+	original = append(original, s.Original[:pos]...)
+	original = append(original, songs...)
+	original = append(original, s.Original[pos:]...)
+	s.Original = original
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// songsFrom builds songs from ids separated by spaces
+func songsFrom(ids string) []Song {
+	var songs []Song
+	for _, v := range strings.Fields(ids) {
+		songs = append(songs, Song{ID: v})
+	}
+
+	return songs
+}
+
+func TestUnshuffle(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		original  string
+		shuffled  string
+		index     int
+		want      string
+		wantIndex int
+	}{
+		{"original order", "a b c d", "c a d b", 0, "a b c d", 2},
+		{"current song last", "a b c d", "b d c a", 3, "a b c d", 0},
+		{"removed while shuffled", "a b c d", "c d a", 1, "a c d", 2},
+		{"added while shuffled go at the end", "a b c", "b e c a f", 0, "a b c e f", 1},
+		{"duplicates kept", "a b a c", "a c b a", 3, "a b a c", 0},
+		{"one duplicate removed", "a b a c", "c a b", 1, "a b c", 0},
+		{"empty queue", "a b c", "", 0, "", 0},
+		{"past the end", "a b c", "c b a", 3, "a b c", 3},
+	} {
+		st := QueueState{Songs: songsFrom(v.shuffled), Original: songsFrom(v.original), Index: v.index, Shuffle: true}
+		st.unshuffle()
+
+		if got := songIDs(st.Songs); got != "["+v.want+"]" || st.Index != v.wantIndex {
+			t.Errorf("%v: unshuffled to %v at %v, want [%v] at %v", v.name, got, st.Index, v.want, v.wantIndex)
+		}
+		if st.Shuffle || st.Original != nil {
+			t.Errorf("%v: still shuffled", v.name)
+		}
+	}
+}
+
+func TestShuffleKeepsCurrentSong(t *testing.T) {
+	for k := range songsFrom("a b c d e") {
+		st := QueueState{Songs: songsFrom("a b c d e"), Index: k}
+		st.shuffle()
+
+		want := string(rune('a' + k))
+		if st.Songs[0].ID != want || st.Index != 0 || len(st.Songs) != 5 {
+			t.Errorf("shuffled from %v to %v at %v", want, songIDs(st.Songs), st.Index)
+		}
+		if songIDs(st.Original) != "[a b c d e]" {
+			t.Errorf("kept %v as the original order", songIDs(st.Original))
+		}
+	}
+}
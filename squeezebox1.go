@@ -8,19 +8,25 @@ import (
 	"fmt"
 	"math"
 	"net"
-	"net/http"
 	"os"
-	"os/exec"
-	"strings"
+	"sync"
 	"time"
 )
 
+// The display is a 280x16 pixel framebuffer, sent with grfd
+const (
+	SB1_DISPLAY_WIDTH  = 280
+	SB1_DISPLAY_HEIGHT = 16
+)
+
 type squeezebox1 struct {
 	Queue *Queue
 
 	conn   *net.TCPConn
-	font   psfFont
+	font   *displayFont
+	mu     sync.Mutex // Protects volume and dsp
 	volume int
+	dsp    DSPSettings
 	mac    net.HardwareAddr
 }
 
@@ -33,7 +39,7 @@ func (s *squeezebox1) GetModel() string {
 }
 
 func (s *squeezebox1) GetName() string {
-	if v, ok := persistent.Clients[s.mac.String()]; ok {
+	if v := getPersistentClient(s.mac.String()); v.Name != "" {
 		return v.Name
 	}
 
@@ -42,25 +48,27 @@ func (s *squeezebox1) GetName() string {
 
 func (s *squeezebox1) Listener() {
 	// Load the font for this player
-	f, err := os.Open("GohaClassic-16.psfu")
-	if err != nil {
-		logger.Panicw("unable read font",
-			"err", err)
-	}
-
-	font := readPSF(f)
-	s.font = font
-	f.Close()
+	s.font = playerFont(s.GetID(), getPersistentClient(s.GetID()).Font, "280x16", 8, 16, "GohaClassic-16.psfu")
 
 	// Display init message
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
-	buf := <-s.DisplayText("SlimYTM", ctx)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	buf := <-s.DisplayText("SlimYTM", nil, ctx)
+	cancel()
 	s.Render(buf)
 	time.Sleep(time.Second * 2)
 	go s.Queue.Composite()
 
-	// Set the volume to 1/2 intially
-	s.SetVolume(50)
+	// Set the volume to 1/2 intially and apply any saved tone settings
+	s.Queue.SetVolume(50)
+	s.Queue.SetDSP(getDSP(s.GetID()))
+	restoreQueue(s.Queue)
+
+	// However the connection ends, remove its queue
+	defer func() {
+		removeQueue(s.Queue)
+		s.conn.Close()
+		metricConnectedPlayers.Dec()
+	}()
 
 	// Start receiving messages
 	for {
@@ -68,16 +76,7 @@ func (s *squeezebox1) Listener() {
 		s.conn.SetReadDeadline(time.Now().Add(HEARTBEAT_INTERVAL * 3))
 		_, err := s.conn.Read(b)
 		if errors.Is(err, os.ErrDeadlineExceeded) {
-			// Client has timed out, remove it from available players
-			for k, v := range queues {
-				if v.Player.GetID() == s.GetID() && v.Player.(*squeezebox1).conn == s.conn {
-					queues = append(queues[:k], queues[k+1:]...)
-				}
-			}
-
 			logger.DPanic("player has timed out")
-			s.conn.Close()
-			metricConnectedPlayers.Dec()
 			return
 		} else if err != nil {
 			logger.Errorw("unable to read from connection",
@@ -90,72 +89,15 @@ func (s *squeezebox1) Listener() {
 		if string(b[:4]) == "STAT" {
 			// Status message from the squeezebox
 			if string(b[8:12]) == "STMa" {
-				s.Queue.Playing = true
-				s.Queue.Loading = false
-				s.Queue.UpdateClients()
+				s.Queue.Started()
 			}
 
 			bytesPlayed := int(binary.BigEndian.Uint64(b[23:31])) - int(binary.BigEndian.Uint32(b[19:23]))
-			elapsed := bytesPlayed / 44100 / 2 / 2
-
-			if s.Queue.ElapsedSecs != elapsed {
-				s.Queue.LastElapsedUpdate = time.Now()
-			}
-			s.Queue.ElapsedSecs = elapsed
+			s.Queue.UpdateElapsed(bytesPlayed / s.GetFormat().BytesPerSecond())
 
 		} else if string(b[:4]) == "IR  " {
-			if time.Since(lastIR) < IR_INTERVAL {
-				// Prevent duplicate IR commands from ruining our day
-				continue
-			}
-
 			// IR command from the remote
-			irCode := hex.EncodeToString(b[14:18])
-			logger.Debugw("ir event",
-				"code", irCode)
-			sendXPL(xplMessage{
-				messageType: "xpl-trig",
-				target:      "*",
-				schema:      "remote.basic",
-				body: map[string]string{
-					"keys":   irCode,
-					"device": s.GetName(),
-					"zone":   "slimserver",
-					"power":  "on",
-				},
-			}, "slimdev-slimserv."+s.GetName())
-
-			if irCode == "7689807f" {
-				// Volume UP
-				s.SetVolume(s.volume + VOLUME_INCREMENT)
-				ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
-				s.Queue.Texts = append(s.Queue.Texts, text{
-					bufs: s.DisplayText(fmt.Sprintf("Volume = %v/100", s.volume), ctx),
-					ctx:  ctx,
-				})
-			} else if irCode == "768900ff" {
-				// Volume DOWN
-				s.SetVolume(s.volume - VOLUME_INCREMENT)
-				ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
-				s.Queue.Texts = append(s.Queue.Texts, text{
-					bufs: s.DisplayText(fmt.Sprintf("Volume = %v/100", s.volume), ctx),
-					ctx:  ctx,
-				})
-			} else if irCode == "7689a05f" {
-				// NEXT Song
-				s.Queue.Next()
-			} else if irCode == "7689c03f" {
-				// PREVIOUS Song
-				s.Queue.Previous()
-			} else if irCode == "768920df" {
-				// PAUSE/UNPAUSE Song
-				s.Queue.Pause()
-			} else if irCode == "768940bf" {
-				// RESET Queue
-				s.Queue.Reset()
-			}
-
-			lastIR = time.Now()
+			handleIR(s, s.Queue, hex.EncodeToString(b[14:18]))
 		}
 	}
 }
@@ -180,122 +122,52 @@ func (s *squeezebox1) Heartbeat() {
 	}
 }
 
-func (s *squeezebox1) DisplayClock() chan []byte {
-	out := make(chan []byte)
-
-	go func() {
-		for {
-			buf := make([]byte, 560)
-			h, m, sec := time.Now().Local().Clock()
-			for k, v := range fmt.Sprintf("                %02d:%02d:%02d", h, m, sec) {
-				// Set each character individually with an offset
-				s.setChar(s.font.getChar(int(v)), k*8, buf)
-			}
-
-			out <- buf
-		}
-	}()
-
-	return out
+func (s *squeezebox1) DisplayClock(ctx context.Context) chan *canvas {
+	return displayClock(SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, s.font, ctx)
 }
 
-// Return a channel of framebuffers, scrolling the text if needed.
-func (s *squeezebox1) DisplayText(text string, ctx context.Context) chan []byte {
-	out := make(chan []byte)
-
-	if len(text) > 35 {
-		// Scroll text across screen
-		text += "    "
-		variableFrame := make([]byte, 2*8*len(text))
-		for k, v := range text {
-			s.setChar(s.font.getChar(int(v)), k*8, variableFrame)
-		}
-
-		go s.scrollBuffer(variableFrame, ctx, out)
-	} else {
-		buf := make([]byte, 560)
-		for k, v := range text {
-			// Set each character individually with an offset
-			s.setChar(s.font.getChar(int(v)), k*8, buf)
-		}
-
-		go func() {
-			// Output the framebuffer until the context expires
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case out <- buf:
-				}
-			}
-		}()
-	}
-
-	return out
+// Return a channel of frames, scrolling the text if needed.
+func (s *squeezebox1) DisplayText(text string, updates chan string, ctx context.Context) chan *canvas {
+	return displayText(SB1_DISPLAY_WIDTH, SB1_DISPLAY_HEIGHT, s.font, text, updates, ctx)
 }
 
-func (s *squeezebox1) Play(videoID string) (cancel func()) {
-retry:
+func (s *squeezebox1) Play(ctx context.Context, videoID string, offset int) error {
 	start := time.Now()
 
-	// Get the player URL with yt-dlp
-	co := exec.Command("yt-dlp", "https://music.youtube.com/watch?v="+videoID, "-f", "bestaudio[ext=webm]", "-g")
-	logger.Debugw("getting audio download url",
-		"cmd", co.String())
-	b, err := co.CombinedOutput()
-	url := strings.Trim(string(b), " \n")
-	logger.Debugw("yt-dlp command output", "output", url)
+	stream, err := resolveStream(videoID)
 	if err != nil {
-		logger.Errorw("unable to get audio download url",
-			"err", err)
-		return
-	}
-
-	// Ensure the url that youtube music returns is actually valid
-	// (stupid google sometimes returns urls that 403)
-	resp, err := http.DefaultClient.Head(url)
-	if err != nil {
-		logger.DPanicw("could not request youtube music url",
-			"err", err)
-		return
-	}
-	if resp.StatusCode != 200 {
-		logger.Warnw("youtube music did not return 200 for url, retrying",
-			"url", url,
-			"status", resp.Status)
-
-		goto retry
+		return err
 	}
+	s.Queue.SetChapters(videoID, stream.Chapters)
 
 	// Start FFMPEG with the URL, piping stdout to our audio buffer
 	s.Queue.Buffer.Reset()
-	ctx, cancel := context.WithCancel(context.Background())
-	fcmd := NewCommand(ctx, "ffmpeg", "-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_delay_max", "5", "-i",
-		string(url), "-f", "wav", "-ar", "44100", "-ac", "2", "-loglevel", "warning", "-vn", "-")
-	fcmd.Stdout = s.Queue.Buffer
-	fcmd.Stderr = os.Stderr
-
-	err = fcmd.Start()
+	err = startTranscode(ctx, stream.URL, offset, s.GetFormat(), s.GetDSP().Filters(true), s.Queue.Buffer)
 	if err != nil {
-		logger.Errorw("unable to start ffmpeg stream",
-			"err", err)
-		return
+		return fmt.Errorf("unable to start ffmpeg stream: %w", err)
 	}
 
 	// Wait until with have at least AUDIO_PRELOAD seconds of audio in our buffer
-	for {
-		time.Sleep(50 * time.Millisecond)
-		if s.Queue.Buffer.Len() > 44100*2*2*AUDIO_PRELOAD {
-			break
+	for s.Queue.Buffer.Len() <= s.GetFormat().BytesPerSecond()*AUDIO_PRELOAD {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
 		}
 	}
 
+	// A newer song may have been loaded while this one was buffering
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	// Send the strm command to the Squeezebox
+	size, rate, channels := s.GetFormat().strmParams()
 	header := fmt.Sprintf("GET /player/%v/audio.wav HTTP/1.0\n\n", s.GetID())
 	msg := make([]byte, 2)
 	binary.BigEndian.PutUint16(msg, uint16(28+len(header)))
 	msg = append(msg, []byte("strm")...)
-	msg = append(msg, 's', '1', 'p', '1', '3', '2', '1', 0xff, 0, 0, '0', 0, 0, 0, 0, 0, 0, 0, 35, 41, 0, 0, 0, 0)
+	msg = append(msg, 's', '1', 'p', size, rate, channels, '1', 0xff, 0, 0, '0', 0, 0, 0, 0, 0, 0, 0, 35, 41, 0, 0, 0, 0)
 	msg = append(msg, []byte(header)...)
 	logger.Debugw("sending play",
 		"len", len(msg),
@@ -306,7 +178,12 @@ retry:
 
 	metricLoadTime.Observe(float64(time.Since(start)) / float64(time.Second))
 
-	return cancel
+	return nil
+}
+
+func (s *squeezebox1) GetFormat() audioFormat {
+	// The MAS35x9 only takes 16 bit 44.1kHz
+	return defaultFormat
 }
 
 func (s *squeezebox1) Stop() {
@@ -363,15 +240,33 @@ func (s *squeezebox1) SetVolume(volume int) {
 		volume = 100
 	}
 
-	level := fmt.Sprintf("%05X", int(0x80000*math.Pow(float64(volume)/100, 2)))
+	// Split the volume between the output matrix with the balance and mono settings
+	dsp := s.GetDSP()
+	gain := 0x80000 * math.Pow(float64(volume)/100, 2)
+	left, right := dsp.ChannelGains()
+	level := func(g float64) string { return fmt.Sprintf("%05X", int(g)) }
+
+	// Balance scales the outputs, so LL and RL feed the left speaker and LR and RR the right
+	var ll, lr, rl, rr string
+	if dsp.Mono {
+		ll, rl = level(gain*left/2), level(gain*left/2)
+		lr, rr = level(gain*right/2), level(gain*right/2)
+	} else {
+		ll, lr = level(gain*left), level(0)
+		rl, rr = level(0), level(gain*right)
+	}
 
 	// out_LL            d0:0354	# volume output control: left->left gain
+	// out_LR            d0:0355	# volume output control: left->right gain
+	// out_RL            d0:0356	# volume output control: right->left gain
 	// out_RR            d0:0357	# volume output control: right->right gain
 	// VOLUME		  cwrite:0010	# volume
 
 	// Digital volume control?
-	i2c := s.makeI2C("d0", "0354", level)
-	i2c = append(i2c, s.makeI2C("d0", "0357", level)...)
+	i2c := s.makeI2C("d0", "0354", ll)
+	i2c = append(i2c, s.makeI2C("d0", "0355", lr)...)
+	i2c = append(i2c, s.makeI2C("d0", "0356", rl)...)
+	i2c = append(i2c, s.makeI2C("d0", "0357", rr)...)
 	i2c = append(i2c, s.makeI2C("cwrite", "0010", "7600")...)
 
 	// Send I2C command
@@ -385,21 +280,63 @@ func (s *squeezebox1) SetVolume(volume int) {
 	s.conn.Write(msg)
 	metricPacketsTx.WithLabelValues(s.GetName()).Inc()
 
+	s.mu.Lock()
 	s.volume = volume
+	s.mu.Unlock()
 }
 
 func (s *squeezebox1) GetVolume() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.volume
 }
 
-func (s *squeezebox1) Render(buf []byte) {
-	if len(buf) != 560 {
-		logger.Panic("framebuffer has incorrect length")
+func (s *squeezebox1) SetDSP(d DSPSettings) bool {
+	d = d.Clamp()
+	s.mu.Lock()
+	restart := d.Filters(true) != s.dsp.Filters(true)
+	s.dsp = d
+	s.mu.Unlock()
+
+	// Balance and mono are applied through the output matrix
+	s.SetVolume(s.GetVolume())
+
+	// BASS		  cwrite:0014	# bass, dB in the high byte
+	// TREBLE	  cwrite:0015	# treble, dB in the high byte
+	i2c := s.makeI2C("cwrite", "0014", toneCode(d.Bass))
+	i2c = append(i2c, s.makeI2C("cwrite", "0015", toneCode(d.Treble))...)
+
+	msg := make([]byte, 2)
+	binary.BigEndian.PutUint16(msg, uint16(4+len(i2c)))
+	msg = append(msg, []byte("i2cc")...)
+	msg = append(msg, []byte(i2c)...)
+	logger.Debugw("sending tone",
+		"len", len(msg),
+		"data", msg)
+	s.conn.Write(msg)
+	metricPacketsTx.WithLabelValues(s.GetName()).Inc()
+
+	// The equaliser is applied by ffmpeg
+	return restart
+}
+
+func (s *squeezebox1) GetDSP() DSPSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dsp
+}
+
+func (s *squeezebox1) Render(c *canvas) {
+	buf, err := encodeGrfd(c)
+	if err != nil {
+		logger.DPanicw("unable to encode frame",
+			"err", err)
+		return
 	}
 
 	// Send the current framebuffer to the Squeezebox
 	msg := make([]byte, 2)
-	binary.BigEndian.PutUint16(msg, 566)
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)+6))
 	msg = append(msg, []byte("grfd")...)
 	msg = append(msg, 0x02, 0x30)
 	msg = append(msg, buf...)
@@ -407,48 +344,6 @@ func (s *squeezebox1) Render(buf []byte) {
 	metricPacketsTx.WithLabelValues(s.GetName()).Inc()
 }
 
-// Displays the whole buffer forever until it cancelled
-func (s *squeezebox1) scrollBuffer(varBuffer []byte, ctx context.Context, out chan []byte) {
-	for {
-		// Wait until we are being composited before starting the timer
-		out <- varBuffer[:560]
-		out <- varBuffer[:560]
-		stationary := time.NewTimer(time.Second * 3)
-
-	outer:
-		for {
-			// Display the first 35 characters for 3 seconds
-			select {
-			case out <- varBuffer[:560]:
-			case <-stationary.C:
-				break outer
-			case <-ctx.Done():
-				// Exit if we have been cancelled (by twitter)
-				return
-			}
-		}
-
-		// Scroll text across until we reach the start
-		for i := 0; i < len(varBuffer); i += 6 {
-			var frame []byte
-			if i > len(varBuffer)-560 {
-				// Current frame overlaps end of buffer
-				frame = append(varBuffer[i:], varBuffer[0:560+i-len(varBuffer)]...)
-			} else {
-				frame = varBuffer[i : i+560]
-			}
-
-			select {
-			case out <- frame:
-			case <-ctx.Done():
-				return
-			}
-		}
-
-		// Continue doing this until we are cancelled
-	}
-}
-
 // makeI2C generates an I2C command string
 func (s *squeezebox1) makeI2C(bank, address, data string) []byte {
 	// Nibbleise(tm) the address and data
@@ -479,20 +374,9 @@ func (s *squeezebox1) makeI2C(bank, address, data string) []byte {
 	return i2c
 }
 
-func (s *squeezebox1) setChar(chr []byte, offset int, buffer []byte) {
-	// Set the chr in the framebuffer
-	i := 2 * offset * 8
-	for col := 0; col < 8; col++ {
-		for _, v := range chr {
-			mask := byte(0b10000000 >> col)
-			if v&mask > 0 {
-				squeezeMask := byte(1 << (7 - i%8))
-				buffer[i/8] |= squeezeMask
-			}
-
-			i++
-		}
-	}
+// toneCode converts a gain in dB into the MAS35x9 tone register format
+func toneCode(db float64) string {
+	return fmt.Sprintf("%04X", uint16(int8(math.Round(db)))<<8)
 }
 
 // Nibbelise converts a hex string into nibbles. Least significant at [0]
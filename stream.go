@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long a resolved stream url is reused for (youtube urls expire after a few hours)
+const STREAM_CACHE_TTL = time.Hour
+
+// Chapter is a section of a song, in seconds from the start
+type Chapter struct {
+	Title string `json:"title"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+type streamInfo struct {
+	URL      string
+	Chapters []Chapter
+	resolved time.Time
+}
+
+var streamCache = make(map[string]streamInfo)
+var streamCacheMu sync.Mutex
+
+// resolveStream gets the audio url and chapters for a video with yt-dlp, or the file for a local song
+func resolveStream(videoID string) (streamInfo, error) {
+	streamCacheMu.Lock()
+	info, ok := streamCache[videoID]
+	streamCacheMu.Unlock()
+	if ok && time.Since(info.resolved) < STREAM_CACHE_TTL {
+		return info, nil
+	}
+
+	// Songs from a local library are played straight from their files
+	if l, ok := catalog.(localStreamer); ok {
+		if path, ok := l.LocalPath(videoID); ok {
+			return streamInfo{URL: path, resolved: time.Now()}, nil
+		}
+	}
+
+retry:
+	co := exec.Command("yt-dlp", "https://music.youtube.com/watch?v="+videoID, "-f", "bestaudio[ext=webm]", "-j")
+	logger.Debugw("getting audio download url",
+		"cmd", co.String())
+	b, err := co.Output()
+	if err != nil {
+		return info, fmt.Errorf("unable to get audio download url: %w", err)
+	}
+
+	var out struct {
+		URL      string `json:"url"`
+		Chapters []struct {
+			Title     string  `json:"title"`
+			StartTime float64 `json:"start_time"`
+			EndTime   float64 `json:"end_time"`
+		} `json:"chapters"`
+	}
+	err = json.Unmarshal(b, &out)
+	if err != nil {
+		return info, fmt.Errorf("unable to parse yt-dlp output: %w", err)
+	}
+	logger.Debugw("yt-dlp command output",
+		"url", out.URL,
+		"chapters", len(out.Chapters))
+
+	// Ensure the url that youtube music returns is actually valid
+	// (stupid google sometimes returns urls that 403)
+	resp, err := http.DefaultClient.Head(out.URL)
+	if err != nil {
+		return info, fmt.Errorf("could not request youtube music url: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		logger.Warnw("youtube music did not return 200 for url, retrying",
+			"url", out.URL,
+			"status", resp.Status)
+
+		goto retry
+	}
+
+	info = streamInfo{URL: out.URL, resolved: time.Now()}
+	for _, v := range out.Chapters {
+		info.Chapters = append(info.Chapters, Chapter{
+			Title: v.Title,
+			Start: int(math.Round(v.StartTime)),
+			End:   int(math.Round(v.EndTime)),
+		})
+	}
+
+	streamCacheMu.Lock()
+	for k, v := range streamCache {
+		if time.Since(v.resolved) >= STREAM_CACHE_TTL {
+			delete(streamCache, k)
+		}
+	}
+	streamCache[videoID] = info
+	streamCacheMu.Unlock()
+
+	return info, nil
+}
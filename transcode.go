@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// startTranscode starts ffmpeg decoding the url from offset seconds into wav of the given format,
+// applying the audio filters. Output is written to out until the context is cancelled.
+func startTranscode(ctx context.Context, url string, offset int, format audioFormat, filters string, out io.Writer) error {
+	// Reconnecting only applies to streams, local files would fail with it
+	var args []string
+	if strings.HasPrefix(url, "http") {
+		args = append(args, "-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_delay_max", "5")
+	}
+	if offset > 0 {
+		args = append(args, "-ss", fmt.Sprint(offset))
+	}
+	args = append(args, "-i", url)
+	if filters != "" {
+		args = append(args, "-af", filters)
+	}
+	args = append(args, "-f", "wav", "-acodec", format.codec(), "-ar", fmt.Sprint(format.SampleRate),
+		"-ac", fmt.Sprint(format.Channels), "-loglevel", "warning", "-vn", "-")
+
+	fcmd := NewCommand(ctx, "ffmpeg", args...)
+	fcmd.Stdout = out
+	fcmd.Stderr = os.Stderr
+
+	return fcmd.Start()
+}
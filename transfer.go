@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long the transfer menu stays open on the display without a button being pressed
+const TRANSFER_MENU_TIMEOUT = 10 * time.Second
+
+// transferMenu lets the remote choose another player to transfer its queue to
+type transferMenu struct {
+	targets []*Queue
+	index   int
+	dismiss func()
+	expires time.Time
+}
+
+var transferMenus = make(map[*Queue]*transferMenu)
+var transferMenusMu sync.Mutex
+
+// findQueue finds the queue for a player id or name, returning nil if there isn't one
+func findQueue(ref string) *Queue {
+	if q := getQueue(ref); q != nil {
+		return q
+	}
+
+	return getQueueByName(ref)
+}
+
+// transferQueue moves the queue of one player to another, carrying on from the same
+// point. The source player stops, and the target's queue is replaced.
+func transferQueue(from, to *Queue) error {
+	if from == to {
+		return errors.New("can't transfer a queue to the same player")
+	}
+
+	if len(from.State().Songs) == 0 {
+		return errors.New("nothing to transfer")
+	}
+
+	saved, playing := from.Take()
+	logger.Infow("transferring queue",
+		"from", from.Player.GetName(),
+		"to", to.Player.GetName(),
+		"songs", len(saved.Songs),
+		"index", saved.Index,
+		"elapsed", saved.ElapsedSecs)
+	to.Restore(saved, playing)
+
+	return nil
+}
+
+// openTransferMenu shows the other players on the display to choose one to transfer to
+func openTransferMenu(q *Queue) {
+	transferMenusMu.Lock()
+	defer transferMenusMu.Unlock()
+
+	m := &transferMenu{}
+	for _, v := range allQueues() {
+		if v != q {
+			m.targets = append(m.targets, v)
+		}
+	}
+
+	if len(m.targets) == 0 {
+		q.PushText("No other players", time.Second*2)
+		return
+	}
+
+	transferMenus[q] = m
+	m.show(q)
+}
+
+// closeTransferMenu forgets the menu of a queue that has gone away
+func closeTransferMenu(q *Queue) {
+	transferMenusMu.Lock()
+	defer transferMenusMu.Unlock()
+	delete(transferMenus, q)
+}
+
+// handleTransferMenu handles the remote while the transfer menu is open.
+// Returns true if the button was used by the menu.
+func handleTransferMenu(q *Queue, irCode string) bool {
+	transferMenusMu.Lock()
+	m := transferMenus[q]
+	if m != nil && time.Now().After(m.expires) {
+		delete(transferMenus, q)
+		m = nil
+	}
+
+	if m == nil {
+		transferMenusMu.Unlock()
+		return false
+	}
+
+	var target *Queue
+	if irCode == "7689e01f" {
+		// UP
+		m.index = (m.index + len(m.targets) - 1) % len(m.targets)
+		m.show(q)
+	} else if irCode == "7689b04f" {
+		// DOWN
+		m.index = (m.index + 1) % len(m.targets)
+		m.show(q)
+	} else if irCode == "7689d02f" || irCode == "768910ef" {
+		// RIGHT or PLAY transfers
+		target = m.targets[m.index]
+		m.dismiss()
+		delete(transferMenus, q)
+	} else if irCode == "7689906f" {
+		// LEFT closes the menu
+		m.dismiss()
+		delete(transferMenus, q)
+	} else {
+		transferMenusMu.Unlock()
+		return false
+	}
+	transferMenusMu.Unlock()
+
+	// The player may have gone while the menu was open
+	if target != nil && getQueue(target.Player.GetID()) != target {
+		q.PushText("Player has gone", time.Second*2)
+	} else if target != nil {
+		err := transferQueue(q, target)
+		if err != nil {
+			logger.Warnw("unable to transfer queue",
+				"err", err)
+			q.PushText("Unable to transfer", time.Second*2)
+		}
+	}
+
+	return true
+}
+
+// show displays the chosen player. Must be called with transferMenusMu held
+func (m *transferMenu) show(q *Queue) {
+	if m.dismiss != nil {
+		m.dismiss()
+	}
+
+	m.expires = time.Now().Add(TRANSFER_MENU_TIMEOUT)
+	m.dismiss = q.PushText(fmt.Sprintf("Transfer to %v (%v/%v)", m.targets[m.index].Player.GetName(), m.index+1, len(m.targets)), TRANSFER_MENU_TIMEOUT)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -125,21 +124,13 @@ func xplListener() {
 					d = 5
 				}
 
-				for _, v := range queues {
-					if v.Player.GetName() == target[1] {
-						cleaned := strings.TrimLeft(x.body["text"], "\\n")
-						cleaned = strings.TrimLeft(cleaned, "\n")
-
-						logger.Debugw("received xPL",
-							"for", v.Player.GetName())
-						ctx, _ := context.WithTimeout(context.Background(), time.Second*time.Duration(d))
-						v.Texts = append(v.Texts, text{
-							bufs: v.Player.DisplayText(cleaned, ctx),
-							ctx:  ctx,
-						})
-
-						break
-					}
+				if v := getQueueByName(target[1]); v != nil {
+					cleaned := strings.TrimLeft(x.body["text"], "\\n")
+					cleaned = strings.TrimLeft(cleaned, "\n")
+
+					logger.Debugw("received xPL",
+						"for", v.Player.GetName())
+					v.PushText(cleaned, time.Second*time.Duration(d))
 				}
 			}
 		}
@@ -168,7 +159,7 @@ func xplHeartbeat() {
 	port := strings.Split(xplPort.LocalAddr().String(), ":")[1]
 
 	for {
-		for _, v := range persistent.Clients {
+		for _, v := range allPersistentClients() {
 			sendXPL(xplMessage{
 				messageType: "xpl-stat",
 				target:      "*",
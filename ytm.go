@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// The address of the python server that talks to youtube music, unless configured otherwise
+const DEFAULT_YTM_API = "http://localhost:9000/api"
+
+var videoIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// ytmCatalog gets music from youtube music through the python server
+type ytmCatalog struct {
+	api string
+}
+
+// get requests a path from the python server and parses the json response
+func (y ytmCatalog) get(path string) (*gabs.Container, error) {
+	resp, err := http.Get(y.api + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ytm api returned %v for %v", resp.Status, path)
+	}
+
+	return gabs.ParseJSONBuffer(resp.Body)
+}
+
+// tracks requests a path from the python server that responds with a list of tracks
+func (y ytmCatalog) tracks(path string) ([]Song, error) {
+	c, err := y.get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var songs []Song
+	err = json.Unmarshal(c.Path("tracks").Bytes(), &songs)
+	if err != nil {
+		return nil, err
+	}
+
+	return songs, nil
+}
+
+func (y ytmCatalog) Browse() ([]Playlist, error) {
+	c, err := y.get("/library/playlists")
+	if err != nil {
+		return nil, err
+	}
+
+	var playlists []Playlist
+	for _, v := range c.Children() {
+		p := Playlist{}
+		p.ID, _ = v.Path("id").Data().(string)
+		p.Title, _ = v.Path("title").Data().(string)
+		p.Thumbnail, _ = v.Path("thumbnail").Data().(string)
+
+		// The count is sometimes a string, and sometimes not a number at all
+		switch count := v.Path("count").Data().(type) {
+		case float64:
+			p.TrackCount = int(count)
+		case string:
+			p.TrackCount, _ = strconv.Atoi(strings.ReplaceAll(count, ",", ""))
+		}
+
+		playlists = append(playlists, p)
+	}
+
+	return playlists, nil
+}
+
+func (y ytmCatalog) Playlist(id string, start int, count int) (Playlist, error) {
+	// The python server keeps the tracks it has loaded, so each page only loads what it needs
+	query := fmt.Sprintf("?start=%v", start)
+	if count > 0 {
+		query += fmt.Sprintf("&limit=%v", count)
+	}
+
+	path := "/playlist/" + url.PathEscape(id) + query
+	if id == LIKED_PLAYLIST {
+		path = "/liked" + query
+	}
+
+	var p Playlist
+	c, err := y.get(path)
+	if err != nil {
+		return p, err
+	}
+
+	err = json.Unmarshal(c.Bytes(), &p)
+	if err != nil {
+		return p, err
+	}
+
+	p.ID = id
+	p.Tracks = pageOf(p.Tracks, 0, count)
+	return p, nil
+}
+
+func (y ytmCatalog) Album(id string) ([]Song, error) {
+	return y.tracks("/album/" + url.PathEscape(id))
+}
+
+func (y ytmCatalog) Artist(id string) ([]Song, error) {
+	return y.tracks("/artist/" + url.PathEscape(id))
+}
+
+func (y ytmCatalog) Search(query string) ([]Song, error) {
+	return y.tracks("/search?q=" + url.QueryEscape(query))
+}
+
+func (y ytmCatalog) Related(videoID string) ([]Song, error) {
+	return y.tracks("/radio/" + url.PathEscape(videoID))
+}
+
+func (y ytmCatalog) Song(videoID string) (Song, error) {
+	var song Song
+
+	c, err := y.get("/song/" + url.PathEscape(videoID))
+	if err != nil {
+		return song, err
+	}
+
+	err = json.Unmarshal(c.Bytes(), &song)
+	if err != nil {
+		return song, err
+	}
+
+	if song.ID == "" {
+		return song, errors.New("ytm api returned a song without an id")
+	}
+
+	return song, nil
+}
+
+// Lyrics fetches time-synced lyrics from youtube music
+func (y ytmCatalog) Lyrics(song Song) ([]lyricLine, error) {
+	resp, err := http.Get(y.api + "/lyrics/" + url.PathEscape(song.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoLyrics
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ytm api returned %v for lyrics", resp.Status)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLRC(string(b))
+}
+
+// parseMediaRef extracts a video or playlist id from a bare id or a youtube/ytm url.
+// Exactly one of the returned ids will be set.
+func parseMediaRef(ref string) (videoID string, playlistID string, err error) {
+	ref = strings.TrimSpace(ref)
+	if videoIDRegex.MatchString(ref) {
+		return ref, "", nil
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not a video id or url", ref)
+	}
+
+	host := strings.TrimPrefix(u.Hostname(), "www.")
+	switch host {
+	case "youtu.be":
+		videoID = strings.Trim(u.Path, "/")
+
+	case "youtube.com", "m.youtube.com", "music.youtube.com":
+		if u.Path == "/playlist" {
+			playlistID = u.Query().Get("list")
+		} else if strings.HasPrefix(u.Path, "/shorts/") {
+			videoID = strings.TrimPrefix(u.Path, "/shorts/")
+		} else {
+			videoID = u.Query().Get("v")
+		}
+
+	default:
+		return "", "", fmt.Errorf("%q is not a youtube url", ref)
+	}
+
+	if playlistID != "" {
+		return "", playlistID, nil
+	}
+
+	if !videoIDRegex.MatchString(videoID) {
+		return "", "", fmt.Errorf("%q does not contain a valid video id", ref)
+	}
+
+	return videoID, "", nil
+}
@@ -2,10 +2,39 @@ from flask.helpers import send_from_directory
 from ytmusicapi import YTMusic
 import flask
 import json
+import threading
+import time
 
 ytmusic = YTMusic("headers_auth.json")
 app = flask.Flask(__name__)
 
+# Playlists are kept for a while once loaded, so each page doesn't load every track before it again
+PLAYLIST_CACHE_SECS = 600
+playlistCache = {}
+playlistCacheLock = threading.Lock()
+
+
+def loadTracks(key, needed, load):
+    # Load at least the needed tracks of a playlist, or all of them if there are fewer.
+    # Each load asks for twice as many as the last, so paging through a playlist loads
+    # it a handful of times rather than once a page
+    with playlistCacheLock:
+        now = time.time()
+        for k in [k for k, v in playlistCache.items() if now - v["time"] > PLAYLIST_CACHE_SECS]:
+            del playlistCache[k]
+
+        cached = playlistCache.get(key)
+        if cached and (cached["complete"] or len(cached["playlist"]["tracks"]) >= needed):
+            return cached["playlist"]
+
+        limit = needed
+        if cached:
+            limit = max(needed, 2 * len(cached["playlist"]["tracks"]))
+
+        playlist = load(limit)
+        playlistCache[key] = {"time": now, "playlist": playlist, "complete": len(playlist["tracks"]) < limit}
+        return playlist
+
 
 @app.route("/api/library/playlists")
 def libraryPlaylists():
@@ -28,16 +57,140 @@ def libraryPlaylists():
 
 @app.route("/api/playlist/<id>")
 def playlist(id):
+    # limit tracks are returned from start, or every track after it without a limit
     limit = flask.request.args.get("limit", 9999999999, type=int)
     start = flask.request.args.get("start", 0, type=int)
-    playlist = ytmusic.get_playlist(id, limit=limit)
+    playlist = dict(loadTracks(("playlist", id), start + limit, lambda n: ytmusic.get_playlist(id, limit=n)))
     playlist["thumbnail"] = playlist["thumbnails"][1]["url"]
     del playlist["thumbnails"]
-    playlist["tracks"] = playlist["tracks"][start:]
+    playlist["tracks"] = playlist["tracks"][start:start + limit]
 
     return json.dumps(playlist, indent=2)
 
 
+@app.route("/api/album/<id>")
+def album(id):
+    try:
+        album = ytmusic.get_album(id)
+    except Exception:
+        return json.dumps({"error": "unknown album"}), 404
+
+    # Album tracks don't have their own album or thumbnails
+    for t in album["tracks"]:
+        t["album"] = {"name": album["title"], "id": id}
+        t["year"] = album.get("year") or ""
+        t["thumbnails"] = album["thumbnails"]
+
+    album["thumbnail"] = album["thumbnails"][-1]["url"]
+    del album["thumbnails"]
+
+    return json.dumps(album, indent=2)
+
+
+@app.route("/api/artist/<id>")
+def artist(id):
+    # The top songs of an artist. The full list is a playlist, if there is one
+    try:
+        songs = ytmusic.get_artist(id)["songs"]
+    except Exception:
+        return json.dumps({"error": "unknown artist"}), 404
+
+    tracks = songs.get("results", [])
+    if songs.get("browseId"):
+        try:
+            tracks = ytmusic.get_playlist(songs["browseId"], limit=100)["tracks"]
+        except Exception:
+            pass
+
+    return json.dumps({"tracks": [formatTrack(t) for t in tracks if t.get("videoId")]}, indent=2)
+
+
+@app.route("/api/liked")
+def liked():
+    # Like playlists, limit tracks are returned from start
+    limit = flask.request.args.get("limit", 5000, type=int)
+    start = flask.request.args.get("start", 0, type=int)
+    liked = loadTracks(("liked",), start + limit, lambda n: ytmusic.get_liked_songs(limit=n))
+    tracks = [formatTrack(t) for t in liked["tracks"][start:start + limit] if t.get("videoId")]
+
+    return json.dumps({"tracks": tracks, "trackCount": liked.get("trackCount", len(liked["tracks"]))}, indent=2)
+
+
+@app.route("/api/search")
+def search():
+    query = flask.request.args.get("q", "")
+    limit = flask.request.args.get("limit", 20, type=int)
+    if query == "":
+        return json.dumps({"error": "no query"}), 400
+
+    results = ytmusic.search(query, filter="songs", limit=limit)
+
+    return json.dumps({"tracks": [formatTrack(t) for t in results if t.get("videoId")]}, indent=2)
+
+
+@app.route("/api/song/<id>")
+def song(id):
+    # Look the track up through its watch playlist. Errors are returned
+    # directly, as aborting would serve index.html
+    try:
+        track = ytmusic.get_watch_playlist(videoId=id, limit=1)["tracks"][0]
+    except Exception:
+        return json.dumps({"error": "unknown video"}), 404
+
+    if track.get("videoId") != id:
+        return json.dumps({"error": "unknown video"}), 404
+
+    return json.dumps(formatTrack(track), indent=2)
+
+
+@app.route("/api/radio/<id>")
+def radio(id):
+    # Tracks related to a song, from its radio watch playlist
+    limit = flask.request.args.get("limit", 25, type=int)
+    try:
+        tracks = ytmusic.get_watch_playlist(videoId=id, radio=True, limit=limit)["tracks"]
+    except Exception:
+        return json.dumps({"error": "unknown video"}), 404
+
+    # The radio starts with the song itself
+    tracks = [formatTrack(t) for t in tracks if t.get("videoId") and t["videoId"] != id]
+
+    return json.dumps({"tracks": tracks}, indent=2)
+
+
+@app.route("/api/lyrics/<id>")
+def lyrics(id):
+    # Returns time-synced lyrics in LRC format
+    try:
+        browseId = ytmusic.get_watch_playlist(videoId=id, limit=1)["lyrics"]
+        lyrics = ytmusic.get_lyrics(browseId, timestamps=True)
+    except Exception:
+        return json.dumps({"error": "no lyrics"}), 404
+
+    if lyrics is None or not lyrics.get("hasTimestamps"):
+        return json.dumps({"error": "no time-synced lyrics"}), 404
+
+    lrc = ""
+    for line in lyrics["lyrics"]:
+        mins, ms = divmod(line.start_time, 60000)
+        lrc += "[%02d:%05.2f]%s\n" % (mins, ms / 1000, line.text)
+
+    return lrc
+
+
+def formatTrack(track):
+    # Convert a watch playlist track into the same shape as a playlist track
+    return {
+        "videoId": track["videoId"],
+        "title": track.get("title", ""),
+        "artists": track.get("artists") or [],
+        "album": track.get("album"),
+        "year": track.get("year") or "",
+        "duration": track.get("length", track.get("duration", "")),
+        "thumbnails": track.get("thumbnail", track.get("thumbnails")) or [],
+    }
+
+
 @app.route("/assets/<path>")
 def assets(path):
     return send_from_directory("assets", path)
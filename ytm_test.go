@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseMediaRef(t *testing.T) {
+	for _, v := range []struct {
+		ref      string
+		video    string
+		playlist string
+	}{
+		{"dQw4w9WgXcQ", "dQw4w9WgXcQ", ""},
+		{"  dQw4w9WgXcQ\n", "dQw4w9WgXcQ", ""},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ", ""},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL123&t=42", "dQw4w9WgXcQ", ""},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ", ""},
+		{"https://music.youtube.com/watch?v=dQw4w9WgXcQ&feature=share", "dQw4w9WgXcQ", ""},
+		{"https://youtu.be/dQw4w9WgXcQ", "dQw4w9WgXcQ", ""},
+		{"https://youtu.be/dQw4w9WgXcQ/", "dQw4w9WgXcQ", ""},
+		{"https://youtube.com/shorts/dQw4w9WgXcQ", "dQw4w9WgXcQ", ""},
+		{"https://music.youtube.com/playlist?list=PLrAXtmErZgOeiKm4sgNOknGvNjby9efdf", "", "PLrAXtmErZgOeiKm4sgNOknGvNjby9efdf"},
+		{"https://www.youtube.com/playlist?list=OLAK5uy_abc", "", "OLAK5uy_abc"},
+
+		// Not references to anything we can play
+		{"", "", ""},
+		{"dQw4w9WgXc", "", ""},
+		{"not a video", "", ""},
+		{"https://example.com/watch?v=dQw4w9WgXcQ", "", ""},
+		{"https://www.youtube.com/watch?v=short", "", ""},
+		{"https://www.youtube.com/watch", "", ""},
+		{"https://www.youtube.com/playlist", "", ""},
+		{"https://youtu.be/", "", ""},
+		{"youtube.com/watch?v=dQw4w9WgXcQ", "", ""},
+	} {
+		video, playlist, err := parseMediaRef(v.ref)
+		if v.video == "" && v.playlist == "" {
+			if err == nil {
+				t.Errorf("%q: parsed as video %q, playlist %q", v.ref, video, playlist)
+			}
+			continue
+		}
+
+		if err != nil || video != v.video || playlist != v.playlist {
+			t.Errorf("%q: parsed as video %q, playlist %q, %v", v.ref, video, playlist, err)
+		}
+	}
+}